@@ -0,0 +1,80 @@
+package main
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authNotice is a notice the server sent before we registered.
+type authNotice struct {
+	text     string
+	received time.Time
+}
+
+// probeAuthNotices exports how the hostname and ident lookups the server
+// reported on before registration went, and how long each took: a broken
+// resolver on the server holds up every connection until its lookups time
+// out. Metrics for a lookup are only exported if the server sent notices
+// about it.
+func probeAuthNotices(p *ircProbe, cfg AuthNoticesConfig) {
+	p.mu.Lock()
+	notices := append([]authNotice(nil), p.authNotices...)
+	p.mu.Unlock()
+
+	exportLookup(p, notices, "dns", cfg.DNSStartRegexp, cfg.DNSSuccessRegexp, cfg.DNSFailureRegexp)
+	exportLookup(p, notices, "ident", cfg.IdentStartRegexp, cfg.IdentSuccessRegexp, cfg.IdentFailureRegexp)
+}
+
+// exportLookup exports irc_server_<lookup>_lookup_success and
+// irc_server_<lookup>_lookup_duration_seconds for the lookup notices
+// matches. The duration runs from the start notice, or from connecting if
+// the server didn't send one, to the success or failure notice.
+func exportLookup(p *ircProbe, notices []authNotice, lookup, startRegexp, successRegexp, failureRegexp string) {
+	start := regexp.MustCompile(startRegexp)
+	success := regexp.MustCompile(successRegexp)
+	failure := regexp.MustCompile(failureRegexp)
+
+	started := p.connectedAt
+	var seen, succeeded bool
+	var finished time.Time
+	for _, notice := range notices {
+		switch {
+		case success.MatchString(notice.text):
+			succeeded, finished = true, notice.received
+		case failure.MatchString(notice.text):
+			finished = notice.received
+		case start.MatchString(notice.text):
+			started = notice.received
+		default:
+			continue
+		}
+		seen = true
+		if !finished.IsZero() {
+			break
+		}
+	}
+	if !seen {
+		return
+	}
+
+	lookupSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_server_" + lookup + "_lookup_success",
+		Help: "server reported its " + lookup + " lookup for the probe succeeded",
+	})
+	p.registry.MustRegister(lookupSuccess)
+	if finished.IsZero() {
+		// the server started the lookup but never said how it went
+		return
+	}
+	if succeeded {
+		lookupSuccess.Set(1)
+	}
+	lookupDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_server_" + lookup + "_lookup_duration_seconds",
+		Help: "time the server took for its " + lookup + " lookup for the probe",
+	})
+	p.registry.MustRegister(lookupDuration)
+	lookupDuration.Set(finished.Sub(started).Seconds())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// probeChannelAccess logs in as the configured account and checks that
+// ChanServ grants it the expected prefix in each configured channel.
+func probeChannelAccess(p *ircProbe, cfg ChannelAccessConfig) {
+	granted := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_channel_expected_prefix_granted",
+		Help: "expected channel prefix was granted after joining",
+	}, []string{"channel", "prefix"})
+	grantDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_channel_prefix_grant_duration_seconds",
+		Help: "time between joining a channel and being granted the expected prefix",
+	}, []string{"channel"})
+	p.registry.MustRegister(granted, grantDuration)
+	for _, channel := range cfg.Channels {
+		granted.WithLabelValues(channel.Name, channel.ExpectedPrefix).Set(0)
+	}
+
+	login := strings.NewReplacer(
+		"{account}", cfg.Account,
+		"{password}", cfg.Password,
+	).Replace(cfg.LoginCommand)
+	if err := identify(p, cfg.NickServ, login); err != nil {
+		log.Printf("[ERROR] Could not log in as %s: %v", cfg.Account, err)
+		return
+	}
+
+	for _, channel := range cfg.Channels {
+		start := time.Now()
+		err := p.awaitPrefix(channel)
+		p.send("PART", channel.Name)
+		if err != nil {
+			log.Printf("[ERROR] %s was not granted in %s: %v", channel.ExpectedPrefix, channel.Name, err)
+			continue
+		}
+		granted.WithLabelValues(channel.Name, channel.ExpectedPrefix).Set(1)
+		grantDuration.WithLabelValues(channel.Name).Set(time.Since(start).Seconds())
+	}
+}
+
+// awaitPrefix joins channel and waits for us to be given its expected
+// prefix, either in the NAMES reply or by a later MODE.
+func (p *ircProbe) awaitPrefix(channel ChannelAccess) error {
+	modes, symbols := splitPrefix(p.server.Features)
+	i := strings.Index(symbols, channel.ExpectedPrefix)
+	if i == -1 || i >= len(modes) {
+		return fmt.Errorf("server PREFIX %q has no %s prefix", p.server.Features["PREFIX"], channel.ExpectedPrefix)
+	}
+	mode, symbol := modes[i], symbols[i]
+
+	if channel.Key != "" {
+		p.send("JOIN", channel.Name, channel.Key)
+	} else {
+		p.send("JOIN", channel.Name)
+	}
+	_, err := p.expectExtending(channel.GrantTimeout, func(msg ircmsg.IrcMessage) bool {
+		switch {
+		case isCommand("MODE")(msg):
+			if len(msg.Params) < 2 || !strings.EqualFold(msg.Params[0], channel.Name) {
+				return false
+			}
+			for _, change := range parseChannelModes(p.server.Features, msg.Params) {
+				if change.add && change.mode == mode && strings.EqualFold(change.param, p.nick) {
+					return true
+				}
+			}
+		case isCommand("353")(msg):
+			if len(msg.Params) < 4 || !strings.EqualFold(msg.Params[2], channel.Name) {
+				return false
+			}
+			for _, name := range strings.Fields(msg.Params[3]) {
+				nick := strings.TrimLeft(name, symbols)
+				prefixes := name[:len(name)-len(nick)]
+				if i := strings.IndexByte(nick, '!'); i != -1 {
+					nick = nick[:i]
+				}
+				if strings.EqualFold(nick, p.nick) {
+					return strings.IndexByte(prefixes, symbol) != -1
+				}
+			}
+		}
+		return false
+	})
+	return err
+}
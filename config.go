@@ -0,0 +1,544 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const defaultModuleName = "default"
+
+// Config is the exporter's configuration file. Each module is a named set of
+// probe options selected with the "module" query parameter.
+type Config struct {
+	Modules   map[string]Module `yaml:"modules"`
+	Discovery DiscoveryConfig   `yaml:"discovery"`
+}
+
+// DiscoveryConfig configures building Prometheus targets from the LINKS (and
+// optionally MAP) output of a seed server.
+type DiscoveryConfig struct {
+	// Seed is the target to list the network's servers from. Discovery is
+	// disabled when it is empty.
+	Seed     string        `yaml:"seed"`
+	Module   string        `yaml:"module"`
+	Interval time.Duration `yaml:"interval"`
+	UseMap   bool          `yaml:"use_map"`
+
+	// TargetTemplate builds a server's target from its name, substituted
+	// for {server}. It defaults to the seed's scheme and port.
+	TargetTemplate string `yaml:"target_template"`
+	// Targets maps server names to targets, overriding TargetTemplate.
+	Targets map[string]string `yaml:"targets"`
+	Exclude []string          `yaml:"exclude"`
+
+	// File, if set, is kept up to date as a file_sd target file.
+	File string `yaml:"file"`
+}
+
+// Module configures how a single probe behaves.
+type Module struct {
+	Timeout    time.Duration `yaml:"timeout"`
+	NickPrefix string        `yaml:"nick_prefix"`
+	User       string        `yaml:"user"`
+	RealName   string        `yaml:"real_name"`
+
+	// PreferredIPProtocol is "ip4" or "ip6" to connect over only that
+	// protocol, or "dual" (the default) to use either, falling back from
+	// one to the other.
+	PreferredIPProtocol string `yaml:"preferred_ip_protocol"`
+	// SourceIPAddress is the local address to connect from.
+	SourceIPAddress string `yaml:"source_ip_address"`
+	// ProxyURL is a socks5://, socks5h:// or http:// (CONNECT) proxy to
+	// connect through. socks5h has the proxy resolve the target's hostname,
+	// as .onion targets need.
+	ProxyURL string `yaml:"proxy_url"`
+	// ProxyProtocol sends a PROXY protocol header before anything else, for
+	// listeners behind HAProxy.
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+	// WebIRC authenticates as a web gateway passing on a user's host.
+	WebIRC WebIRCConfig `yaml:"webirc"`
+
+	TLS TLSConfig `yaml:"tls_config"`
+	DNS DNSConfig `yaml:"dns"`
+	STS STSConfig `yaml:"sts"`
+
+	WebSocket WebSocketConfig `yaml:"websocket"`
+
+	Services      ServicesConfig      `yaml:"services"`
+	ChannelAccess ChannelAccessConfig `yaml:"channel_access"`
+	Oper          OperConfig          `yaml:"oper"`
+	Links         LinksConfig         `yaml:"links"`
+	AuthNotices   AuthNoticesConfig   `yaml:"auth_notices"`
+	// ErrorReasons classify the ERROR lines and ban numerics the server
+	// sends. The first whose regexp matches a line's text gives its reason.
+	ErrorReasons []ErrorReason `yaml:"error_reasons"`
+}
+
+// DNSConfig configures how the target's hostname is resolved.
+type DNSConfig struct {
+	// ProbeAllAddresses probes every address the hostname resolves to,
+	// labelling each address's metrics with it.
+	ProbeAllAddresses bool `yaml:"probe_all_addresses"`
+	// SRVProbeAll probes every record of an irc+srv or ircs+srv target,
+	// rather than just the one a client would pick first.
+	SRVProbeAll bool `yaml:"srv_probe_all"`
+	// Resolver is the host:port of the DNS server to use instead of the
+	// system's.
+	Resolver string `yaml:"resolver"`
+}
+
+// TLSConfig configures the TLS connection to ircs targets.
+type TLSConfig struct {
+	// CertFile and KeyFile present a client certificate, e.g. for
+	// certificate fingerprint (certfp) based OPER blocks.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// DANE checks the presented certificate chain against the TLSA records
+	// for the target's port, looked up through dns.resolver if set.
+	DANE bool `yaml:"dane"`
+	// SPKIPins are the SHA-256 hashes, in hex or base64, of the public keys
+	// the server's leaf certificate is allowed to have.
+	SPKIPins []string `yaml:"spki_pins"`
+	// OCSPFetch also asks the leaf certificate's OCSP responder for its
+	// status, rather than relying on what the server staples.
+	OCSPFetch bool `yaml:"ocsp_fetch"`
+	// OCSPProxyURL is the HTTP proxy to reach the responder through. The
+	// HTTP_PROXY environment variables are used if it's empty.
+	OCSPProxyURL string `yaml:"ocsp_proxy_url"`
+	// Audit makes extra handshakes to find which TLS versions and which of
+	// AuditCipherSuites the server accepts.
+	Audit bool `yaml:"audit"`
+	// AuditCipherSuites are the names of the cipher suites to audit, as Go
+	// names them. It defaults to every suite Go considers insecure.
+	AuditCipherSuites []string `yaml:"audit_cipher_suites"`
+	// CheckResumption makes two more connections to check the server lets
+	// the second resume the first's session.
+	CheckResumption bool `yaml:"check_resumption"`
+}
+
+// ProxyProtocolConfig configures the PROXY protocol header sent on
+// connecting.
+type ProxyProtocolConfig struct {
+	// Version is 1 or 2, or 0 to send no header.
+	Version int `yaml:"version"`
+	// SourceAddress is the ip or ip:port the header claims the connection
+	// comes from.
+	SourceAddress string `yaml:"source_address"`
+	// ExpectedHost is the host the ircd should report for us in
+	// RPL_WELCOME or RPL_HOSTHIDDEN. It defaults to the source IP.
+	ExpectedHost string `yaml:"expected_host"`
+}
+
+// source returns the spoofed source IP and port.
+func (c ProxyProtocolConfig) source() (net.IP, int, error) {
+	host, port := c.SourceAddress, "0"
+	if h, p, err := net.SplitHostPort(c.SourceAddress); err == nil {
+		host, port = h, p
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("%q is not an IP address", host)
+	}
+	portNumber, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid port %q", port)
+	}
+	return ip, int(portNumber), nil
+}
+
+// expectedHost returns the host the ircd should report for us.
+func (c ProxyProtocolConfig) expectedHost() string {
+	if c.ExpectedHost != "" {
+		return c.ExpectedHost
+	}
+	ip, _, _ := c.source()
+	return ip.String()
+}
+
+// WebIRCConfig configures sending WEBIRC on connecting. It is sent only if
+// Password is set.
+type WebIRCConfig struct {
+	Password string `yaml:"password"`
+	Gateway  string `yaml:"gateway"`
+	// Hostname and IP are the user's host to have the server use for us.
+	Hostname string `yaml:"hostname"`
+	IP       string `yaml:"ip"`
+	// ExpectedHost is the host the ircd should report for us in
+	// RPL_WELCOME or RPL_HOSTHIDDEN. It defaults to Hostname.
+	ExpectedHost string `yaml:"expected_host"`
+}
+
+// expectedHost returns the host the ircd should report for us.
+func (c WebIRCConfig) expectedHost() string {
+	if c.ExpectedHost != "" {
+		return c.ExpectedHost
+	}
+	return c.Hostname
+}
+
+// WebSocketConfig configures the WebSocket upgrade for ws:// and wss://
+// targets.
+type WebSocketConfig struct {
+	// Subprotocols are the IRCv3 subprotocols to offer, in order of
+	// preference.
+	Subprotocols []string `yaml:"subprotocols"`
+	// Origin is sent as the Origin header, for ircds that only accept
+	// WebSocket connections from their own webchat.
+	Origin string `yaml:"origin"`
+}
+
+// STSConfig configures checking the IRCv3 strict transport security policy
+// of irc:// targets.
+type STSConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RequireOnPlaintext asserts that a plaintext target must either
+	// advertise STS or refuse registration, exported as
+	// irc_sts_policy_compliant.
+	RequireOnPlaintext bool `yaml:"require_on_plaintext"`
+}
+
+// ServicesConfig configures the services registration lifecycle check.
+type ServicesConfig struct {
+	Enabled                bool   `yaml:"enabled"`
+	NickServ               string `yaml:"nickserv"`
+	ChanServ               string `yaml:"chanserv"`
+	Email                  string `yaml:"email"`
+	ChannelPrefix          string `yaml:"channel_prefix"`
+	UseAccountRegistration bool   `yaml:"use_account_registration"`
+
+	NickRegisterCommand    string `yaml:"nick_register_command"`
+	LoginCommand           string `yaml:"login_command"`
+	NickDropCommand        string `yaml:"nick_drop_command"`
+	ChannelRegisterCommand string `yaml:"channel_register_command"`
+	ChannelOpCommand       string `yaml:"channel_op_command"`
+	ChannelDropCommand     string `yaml:"channel_drop_command"`
+
+	NickRegisteredRegexp    string `yaml:"nick_registered_regexp"`
+	NickDroppedRegexp       string `yaml:"nick_dropped_regexp"`
+	ChannelRegisteredRegexp string `yaml:"channel_registered_regexp"`
+	ChannelDroppedRegexp    string `yaml:"channel_dropped_regexp"`
+	// NickRegisterFailedRegexp and ChannelRegisterFailedRegexp recognise
+	// services refusing to register. They're checked first, as refusals
+	// like "is already registered" often match the success regexps too.
+	NickRegisterFailedRegexp    string `yaml:"nick_register_failed_regexp"`
+	ChannelRegisterFailedRegexp string `yaml:"channel_register_failed_regexp"`
+	// DropConfirmRegexp extracts the confirmation command some services
+	// ask for before dropping a nick or channel.
+	DropConfirmRegexp string `yaml:"drop_confirm_regexp"`
+}
+
+// ChannelAccessConfig configures the check that ChanServ grants a known
+// account its expected prefix in each of Channels.
+type ChannelAccessConfig struct {
+	Account      string          `yaml:"account"`
+	Password     string          `yaml:"password"`
+	NickServ     string          `yaml:"nickserv"`
+	LoginCommand string          `yaml:"login_command"`
+	Channels     []ChannelAccess `yaml:"channels"`
+}
+
+// ChannelAccess is a channel the ChannelAccessConfig account should be given
+// ExpectedPrefix in within GrantTimeout of joining. The wait doesn't count
+// against the module's timeout, so a probe can take up to every channel's
+// GrantTimeout longer.
+type ChannelAccess struct {
+	Name           string        `yaml:"name"`
+	Key            string        `yaml:"key"`
+	ExpectedPrefix string        `yaml:"expected_prefix"`
+	GrantTimeout   time.Duration `yaml:"grant_timeout"`
+}
+
+// UnmarshalYAML fills in defaults for any options a channel leaves unset.
+func (c *ChannelAccess) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = ChannelAccess{
+		ExpectedPrefix: "@",
+		GrantTimeout:   10 * time.Second,
+	}
+	type plain ChannelAccess
+	return unmarshal((*plain)(c))
+}
+
+// OperConfig configures sending OPER and collecting STATS output once opered.
+// With a client certificate in TLSConfig, Password may be left empty for
+// ircds that match the OPER block on certfp alone.
+type OperConfig struct {
+	Name     string   `yaml:"name"`
+	Password string   `yaml:"password"`
+	Stats    []string `yaml:"stats"`
+}
+
+// LinksConfig configures the network topology check.
+type LinksConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// UseMap also sends MAP, which lists servers some ircds hide from LINKS.
+	UseMap          bool     `yaml:"use_map"`
+	ExpectedServers []string `yaml:"expected_servers"`
+}
+
+// AuthNoticesConfig configures checking the hostname and ident lookups the
+// server reports on in notices before registration, such as "*** Looking up
+// your hostname...". Each lookup's start, success and failure notices are
+// recognised by a regexp.
+type AuthNoticesConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	DNSStartRegexp     string `yaml:"dns_start_regexp"`
+	DNSSuccessRegexp   string `yaml:"dns_success_regexp"`
+	DNSFailureRegexp   string `yaml:"dns_failure_regexp"`
+	IdentStartRegexp   string `yaml:"ident_start_regexp"`
+	IdentSuccessRegexp string `yaml:"ident_success_regexp"`
+	IdentFailureRegexp string `yaml:"ident_failure_regexp"`
+}
+
+// ErrorReason is the reason given to ERROR lines and ban numerics whose text
+// matches Regexp.
+type ErrorReason struct {
+	Reason string `yaml:"reason"`
+	Regexp string `yaml:"regexp"`
+}
+
+var defaultModule = Module{
+	Timeout:    10 * time.Second,
+	NickPrefix: "promirc_",
+	User:       "promirc",
+	RealName:   "prometheus irc exporter",
+	Services: ServicesConfig{
+		NickServ:      "NickServ",
+		ChanServ:      "ChanServ",
+		Email:         "promirc@example.invalid",
+		ChannelPrefix: "#promirc_",
+
+		NickRegisterCommand:    "REGISTER {password} {email}",
+		LoginCommand:           "IDENTIFY {password}",
+		NickDropCommand:        "DROP {nick} {password}",
+		ChannelRegisterCommand: "REGISTER {channel}",
+		ChannelOpCommand:       "OP {channel} {nick}",
+		ChannelDropCommand:     "DROP {channel}",
+
+		NickRegisteredRegexp:    `(?i)(registered|created)`,
+		NickDroppedRegexp:       `(?i)(dropped|deleted)`,
+		ChannelRegisteredRegexp: `(?i)registered`,
+		ChannelDroppedRegexp:    `(?i)(dropped|deleted)`,
+		DropConfirmRegexp:       `(?i)/msg \S+ (DROP \S+ \S+)`,
+
+		// not "invalid" anywhere, which would match the .invalid email
+		// services echo back when registration succeeds
+		NickRegisterFailedRegexp:    `(?i)(already|denied|(^|\s)invalid|not a valid|failed|cannot|can't|must|too many|not allowed)`,
+		ChannelRegisterFailedRegexp: `(?i)(already|denied|(^|\s)invalid|not a valid|failed|cannot|can't|must|too many|not allowed)`,
+	},
+	WebSocket: WebSocketConfig{
+		Subprotocols: []string{textSubprotocol, binarySubprotocol},
+	},
+	ChannelAccess: ChannelAccessConfig{
+		NickServ:     "NickServ",
+		LoginCommand: "IDENTIFY {account} {password}",
+	},
+	AuthNotices: AuthNoticesConfig{
+		DNSStartRegexp:     `(?i)looking up your hostname`,
+		DNSSuccessRegexp:   `(?i)found your hostname`,
+		DNSFailureRegexp:   `(?i)(couldn't|could not|unable to) (look up|resolve) your hostname`,
+		IdentStartRegexp:   `(?i)(checking ident|looking up your ident)`,
+		IdentSuccessRegexp: `(?i)(got ident response|received identd response|found your ident)`,
+		IdentFailureRegexp: `(?i)(no ident response|could not find your ident)`,
+	},
+	ErrorReasons: []ErrorReason{
+		{Reason: "dnsbl", Regexp: `(?i)(dnsbl|dronebl|\brbl\b|blacklist|blocklist|listed in)`},
+		{Reason: "server_full", Regexp: `(?i)(server is full|no more connections|too many (clients|users))`},
+		{Reason: "throttled", Regexp: `(?i)(too fast|throttl|too many (host |user )?connections)`},
+		{Reason: "banned", Regexp: `(?i)([kdgz]-?lined|banned|\bban\b|not welcome)`},
+		{Reason: "auth_required", Regexp: `(?i)(password|sasl|authenticat|identify)`},
+	},
+}
+
+// UnmarshalYAML fills in defaults for any options a module leaves unset.
+func (m *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*m = defaultModule
+	type plain Module
+	return unmarshal((*plain)(m))
+}
+
+// needsRegistration reports whether any of the module's checks run after IRC
+// registration, rather than just on the connection. The ident checks, run
+// whenever the identd is, always do.
+func (m Module) needsRegistration() bool {
+	return identServer != nil || m.Services.Enabled || len(m.ChannelAccess.Channels) > 0 || m.Oper.Name != "" ||
+		m.Links.Enabled || m.STS.RequireOnPlaintext || m.ProxyProtocol.Version != 0 ||
+		m.WebIRC.Password != "" || m.AuthNotices.Enabled
+}
+
+// loadConfig reads the configuration file at path. An empty path yields a
+// configuration holding only the default module.
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{Modules: map[string]Module{}}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", path, err)
+		}
+	}
+	if _, ok := cfg.Modules[defaultModuleName]; !ok {
+		cfg.Modules[defaultModuleName] = defaultModule
+	}
+	for name, module := range cfg.Modules {
+		if err := module.validate(); err != nil {
+			return nil, fmt.Errorf("module %s: %v", name, err)
+		}
+	}
+	if err := cfg.Discovery.validate(cfg); err != nil {
+		return nil, fmt.Errorf("discovery: %v", err)
+	}
+	return cfg, nil
+}
+
+// validate checks the discovery options and fills in defaults for unset
+// ones.
+func (d *DiscoveryConfig) validate(cfg *Config) error {
+	if d.Seed == "" {
+		return nil
+	}
+	seed, err := parseTarget(d.Seed)
+	if err != nil {
+		return err
+	}
+	if isSRV(seed) {
+		return errors.New("seed can't be an SRV target")
+	}
+	if d.Module == "" {
+		d.Module = defaultModuleName
+	}
+	if _, ok := cfg.Modules[d.Module]; !ok {
+		return fmt.Errorf("unknown module %q", d.Module)
+	}
+	if d.Interval == 0 {
+		d.Interval = 5 * time.Minute
+	}
+	if d.TargetTemplate == "" {
+		d.TargetTemplate = seed.Scheme + "://{server}"
+		if seed.Port() != "" {
+			d.TargetTemplate += ":" + seed.Port()
+		}
+	}
+	return nil
+}
+
+// validate checks the options that can't be checked by unmarshalling alone,
+// so probes can rely on them, e.g. with regexp.MustCompile.
+func (m Module) validate() error {
+	for _, re := range []string{
+		m.Services.NickRegisteredRegexp,
+		m.Services.NickDroppedRegexp,
+		m.Services.ChannelRegisteredRegexp,
+		m.Services.ChannelDroppedRegexp,
+		m.Services.NickRegisterFailedRegexp,
+		m.Services.ChannelRegisterFailedRegexp,
+		m.Services.DropConfirmRegexp,
+		m.AuthNotices.DNSStartRegexp,
+		m.AuthNotices.DNSSuccessRegexp,
+		m.AuthNotices.DNSFailureRegexp,
+		m.AuthNotices.IdentStartRegexp,
+		m.AuthNotices.IdentSuccessRegexp,
+		m.AuthNotices.IdentFailureRegexp,
+	} {
+		if _, err := regexp.Compile(re); err != nil {
+			return err
+		}
+	}
+	for _, reason := range m.ErrorReasons {
+		if reason.Reason == "" {
+			return errors.New("error_reasons: every reason needs a name")
+		}
+		if _, err := regexp.Compile(reason.Regexp); err != nil {
+			return fmt.Errorf("error_reasons: %s: %v", reason.Reason, err)
+		}
+	}
+	switch m.PreferredIPProtocol {
+	case "", "dual", "ip4", "ip6":
+	default:
+		return fmt.Errorf("preferred_ip_protocol must be ip4, ip6 or dual, not %q", m.PreferredIPProtocol)
+	}
+	if m.DNS.Resolver != "" {
+		if _, _, err := net.SplitHostPort(m.DNS.Resolver); err != nil {
+			return fmt.Errorf("dns: resolver: %v", err)
+		}
+	}
+	if m.SourceIPAddress != "" && net.ParseIP(m.SourceIPAddress) == nil {
+		return fmt.Errorf("source_ip_address %q is not an IP address", m.SourceIPAddress)
+	}
+	if m.ProxyURL != "" {
+		proxyURL, err := url.Parse(m.ProxyURL)
+		if err != nil {
+			return fmt.Errorf("proxy_url: %v", err)
+		}
+		switch proxyURL.Scheme {
+		case "socks5", "socks5h", "http":
+		default:
+			return fmt.Errorf("proxy_url must have socks5, socks5h or http scheme, not %q", proxyURL.Scheme)
+		}
+	}
+	switch m.ProxyProtocol.Version {
+	case 0:
+	case 1, 2:
+		if _, _, err := m.ProxyProtocol.source(); err != nil {
+			return fmt.Errorf("proxy_protocol: source_address: %v", err)
+		}
+	default:
+		return fmt.Errorf("proxy_protocol: version must be 1 or 2, not %d", m.ProxyProtocol.Version)
+	}
+	if m.WebIRC.Password != "" {
+		if m.WebIRC.Gateway == "" || m.WebIRC.Hostname == "" {
+			return errors.New("webirc: gateway and hostname must be set")
+		}
+		if net.ParseIP(m.WebIRC.IP) == nil {
+			return fmt.Errorf("webirc: ip %q is not an IP address", m.WebIRC.IP)
+		}
+	}
+	if (m.TLS.CertFile == "") != (m.TLS.KeyFile == "") {
+		return errors.New("tls_config: cert_file and key_file must be set together")
+	}
+	if m.TLS.OCSPProxyURL != "" {
+		if _, err := url.Parse(m.TLS.OCSPProxyURL); err != nil {
+			return fmt.Errorf("tls_config: ocsp_proxy_url: %v", err)
+		}
+	}
+	suites := auditableCipherSuites()
+	for _, suite := range m.TLS.AuditCipherSuites {
+		if _, ok := suites[suite]; !ok {
+			return fmt.Errorf("tls_config: cipher suite %q is unknown or can't be audited", suite)
+		}
+	}
+	for _, pin := range m.TLS.SPKIPins {
+		if _, err := decodePin(pin); err != nil {
+			return fmt.Errorf("tls_config: spki pin %q: %v", pin, err)
+		}
+	}
+	for _, subprotocol := range m.WebSocket.Subprotocols {
+		if subprotocol != textSubprotocol && subprotocol != binarySubprotocol {
+			return fmt.Errorf("websocket: unknown subprotocol %q", subprotocol)
+		}
+	}
+	if m.STS.RequireOnPlaintext && !m.STS.Enabled {
+		return errors.New("sts: require_on_plaintext needs enabled")
+	}
+	for _, channel := range m.ChannelAccess.Channels {
+		if len(channel.ExpectedPrefix) != 1 {
+			return fmt.Errorf("channel %s: expected_prefix must be a single prefix symbol", channel.Name)
+		}
+	}
+	for _, query := range m.Oper.Stats {
+		if len(query) != 1 {
+			return fmt.Errorf("oper: stats query %q must be a single letter", query)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeTLSA is the TLSA record type, which dnsmessage has no constant for.
+const typeTLSA = dnsmessage.Type(52)
+
+// TLSA certificate usages, selectors and matching types from RFC 6698.
+const (
+	usagePKIXTA = 0
+	usagePKIXEE = 1
+	usageDANETA = 2
+	usageDANEEE = 3
+
+	selectorCert = 0
+	selectorSPKI = 1
+
+	matchingFull   = 0
+	matchingSHA256 = 1
+	matchingSHA512 = 2
+)
+
+// tlsaRecord is a single TLSA record.
+type tlsaRecord struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	Data         []byte
+}
+
+// probeDANE checks the certificate chain in state against the TLSA records
+// published for address's port on tgt's host.
+func probeDANE(host, address string, state tls.ConnectionState, module Module, registry *prometheus.Registry) {
+	valid := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_tls_dane_valid",
+		Help: "presented certificate chain matches a published tlsa record",
+	})
+	records := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_tls_dane_records",
+		Help: "number of tlsa records published for the target",
+	})
+	authenticated := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_tls_dane_authenticated_data",
+		Help: "resolver marked the tlsa records as dnssec validated",
+	})
+	matched := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_tls_dane_match_info",
+		Help: "tlsa record the presented certificate chain matched",
+	}, []string{"usage", "selector", "matching_type"})
+	registry.MustRegister(valid, records, authenticated, matched)
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		log.Printf("[ERROR] Could not look up TLSA records: %v", err)
+		return
+	}
+	name := fmt.Sprintf("_%s._tcp.%s", port, host)
+	tlsa, ad, err := lookupTLSA(name, module)
+	if err != nil {
+		log.Printf("[ERROR] Could not look up TLSA records for %s: %v", name, err)
+		return
+	}
+	records.Set(float64(len(tlsa)))
+	if ad {
+		authenticated.Set(1)
+	}
+
+	record := daneMatch(tlsa, host, state.PeerCertificates)
+	if record == nil {
+		return
+	}
+	valid.Set(1)
+	matched.WithLabelValues(
+		strconv.Itoa(int(record.Usage)),
+		strconv.Itoa(int(record.Selector)),
+		strconv.Itoa(int(record.MatchingType)),
+	).Set(1)
+}
+
+// daneMatch returns the first of records that authenticates chain for host,
+// or nil if none does.
+func daneMatch(records []tlsaRecord, host string, chain []*x509.Certificate) *tlsaRecord {
+	if len(chain) == 0 {
+		return nil
+	}
+	leaf := chain[0]
+	for i, record := range records {
+		switch record.Usage {
+		case usageDANEEE:
+			// the record pins the leaf itself, without any name or PKIX
+			// checks
+			if record.matches(leaf) {
+				return &records[i]
+			}
+		case usagePKIXEE:
+			if record.matches(leaf) && verifyChain(host, chain, nil) != nil {
+				return &records[i]
+			}
+		case usageDANETA:
+			for _, cert := range chain {
+				if !record.matches(cert) {
+					continue
+				}
+				roots := x509.NewCertPool()
+				roots.AddCert(cert)
+				if verifyChain(host, chain, roots) != nil {
+					return &records[i]
+				}
+			}
+		case usagePKIXTA:
+			for _, verified := range verifyChain(host, chain, nil) {
+				for _, cert := range verified {
+					if record.matches(cert) {
+						return &records[i]
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// verifyChain verifies chain for host against roots, or the system roots if
+// roots is nil, returning the verified chains.
+func verifyChain(host string, chain []*x509.Certificate, roots *x509.CertPool) [][]*x509.Certificate {
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	verified, err := chain[0].Verify(x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return nil
+	}
+	return verified
+}
+
+// matches reports whether the record's data matches cert.
+func (r tlsaRecord) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case selectorCert:
+		data = cert.Raw
+	case selectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+	switch r.MatchingType {
+	case matchingFull:
+	case matchingSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case matchingSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// lookupTLSA queries the module's resolver, or the system's first
+// nameserver, for name's TLSA records. It also returns whether the resolver
+// set the AD bit, i.e. validated the answer with DNSSEC.
+func lookupTLSA(name string, module Module) ([]tlsaRecord, bool, error) {
+	server := module.DNS.Resolver
+	if server == "" {
+		var err error
+		if server, err = systemNameserver(); err != nil {
+			return nil, false, err
+		}
+	}
+
+	qname, err := dnsmessage.NewName(strings.TrimSuffix(name, ".") + ".")
+	if err != nil {
+		return nil, false, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{
+		ID:               id,
+		RecursionDesired: true,
+		// asks the resolver to tell us whether it validated the answer
+		AuthenticData: true,
+	})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return nil, false, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: qname, Type: typeTLSA, Class: dnsmessage.ClassINET}); err != nil {
+		return nil, false, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return nil, false, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(1232, dnsmessage.RCodeSuccess, false); err != nil {
+		return nil, false, err
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return nil, false, err
+	}
+	query, err := builder.Finish()
+	if err != nil {
+		return nil, false, err
+	}
+
+	deadline := time.Now().Add(module.Timeout)
+	resp, err := exchange("udp", server, query, deadline)
+	if err != nil {
+		return nil, false, err
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, false, err
+	}
+	if msg.Header.Truncated {
+		if resp, err = exchange("tcp", server, query, deadline); err != nil {
+			return nil, false, err
+		}
+		if err := msg.Unpack(resp); err != nil {
+			return nil, false, err
+		}
+	}
+	if msg.Header.ID != id {
+		return nil, false, errors.New("dns response id does not match query")
+	}
+
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, msg.Header.AuthenticData, nil
+	default:
+		return nil, false, fmt.Errorf("dns query failed: %v", msg.Header.RCode)
+	}
+
+	var records []tlsaRecord
+	for _, answer := range msg.Answers {
+		// CNAMEs the resolver followed come back alongside the records
+		if answer.Header.Type != typeTLSA {
+			continue
+		}
+		body, ok := answer.Body.(*dnsmessage.UnknownResource)
+		if !ok || len(body.Data) < 3 {
+			return nil, false, errors.New("malformed tlsa record")
+		}
+		records = append(records, tlsaRecord{
+			Usage:        body.Data[0],
+			Selector:     body.Data[1],
+			MatchingType: body.Data[2],
+			Data:         body.Data[3:],
+		})
+	}
+	return records, msg.Header.AuthenticData, nil
+}
+
+// exchange sends query to server over network ("udp" or "tcp") and returns
+// the response.
+func exchange(network, server string, query []byte, deadline time.Time) ([]byte, error) {
+	conn, err := net.DialTimeout(network, server, time.Until(deadline))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	if network == "udp" {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, 65535)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, err
+		}
+		return resp[:n], nil
+	}
+
+	// DNS over TCP prefixes each message with its length
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+	var length uint16
+	if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, length)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// systemNameserver returns the host:port of the first nameserver in
+// /etc/resolv.conf.
+func systemNameserver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
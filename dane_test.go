@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newTestChain returns a leaf certificate for host signed by a fresh CA,
+// followed by the CA.
+func newTestChain(t *testing.T, host string) []*x509.Certificate {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leafKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leafTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTemplate, ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []*x509.Certificate{leaf, ca}
+}
+
+func sha256Of(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func sha512Of(data []byte) []byte {
+	sum := sha512.Sum512(data)
+	return sum[:]
+}
+
+func TestDANEMatch(t *testing.T) {
+	chain := newTestChain(t, "irc.example.net")
+	leaf, ca := chain[0], chain[1]
+	other := newTestChain(t, "irc.example.net")[0]
+
+	tests := []struct {
+		name    string
+		record  tlsaRecord
+		host    string
+		matched bool
+	}{
+		{"DANE-EE SPKI SHA-256", tlsaRecord{usageDANEEE, selectorSPKI, matchingSHA256, sha256Of(leaf.RawSubjectPublicKeyInfo)}, "irc.example.net", true},
+		{"DANE-EE SPKI SHA-512", tlsaRecord{usageDANEEE, selectorSPKI, matchingSHA512, sha512Of(leaf.RawSubjectPublicKeyInfo)}, "irc.example.net", true},
+		{"DANE-EE full certificate", tlsaRecord{usageDANEEE, selectorCert, matchingFull, leaf.Raw}, "irc.example.net", true},
+		{"DANE-EE ignores the name", tlsaRecord{usageDANEEE, selectorCert, matchingSHA256, sha256Of(leaf.Raw)}, "other.example.net", true},
+		{"DANE-EE other certificate", tlsaRecord{usageDANEEE, selectorSPKI, matchingSHA256, sha256Of(other.RawSubjectPublicKeyInfo)}, "irc.example.net", false},
+		{"DANE-TA CA", tlsaRecord{usageDANETA, selectorSPKI, matchingSHA256, sha256Of(ca.RawSubjectPublicKeyInfo)}, "irc.example.net", true},
+		{"DANE-TA CA wrong name", tlsaRecord{usageDANETA, selectorSPKI, matchingSHA256, sha256Of(ca.RawSubjectPublicKeyInfo)}, "other.example.net", false},
+		{"PKIX-EE untrusted chain", tlsaRecord{usagePKIXEE, selectorSPKI, matchingSHA256, sha256Of(leaf.RawSubjectPublicKeyInfo)}, "irc.example.net", false},
+		{"PKIX-TA untrusted chain", tlsaRecord{usagePKIXTA, selectorSPKI, matchingSHA256, sha256Of(ca.RawSubjectPublicKeyInfo)}, "irc.example.net", false},
+		{"unknown selector", tlsaRecord{usageDANEEE, 7, matchingFull, leaf.Raw}, "irc.example.net", false},
+		{"unknown matching type", tlsaRecord{usageDANEEE, selectorCert, 7, leaf.Raw}, "irc.example.net", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matched := daneMatch([]tlsaRecord{test.record}, test.host, chain)
+			if (matched != nil) != test.matched {
+				t.Errorf("daneMatch() = %v, want match %v", matched, test.matched)
+			}
+		})
+	}
+}
+
+func TestDANEMatchPicksMatchingRecord(t *testing.T) {
+	chain := newTestChain(t, "irc.example.net")
+	records := []tlsaRecord{
+		{usageDANEEE, selectorSPKI, matchingSHA256, make([]byte, sha256.Size)},
+		{usageDANEEE, selectorCert, matchingSHA256, sha256Of(chain[0].Raw)},
+	}
+	if matched := daneMatch(records, "irc.example.net", chain); matched != &records[1] {
+		t.Errorf("daneMatch() = %v, want the second record", matched)
+	}
+	if matched := daneMatch(records, "irc.example.net", nil); matched != nil {
+		t.Errorf("daneMatch() with no chain = %v, want nil", matched)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/url"
+	"path/filepath"
+	"time"
+)
+
+// dial connects to address as the module asks, in place of the plain
+// net.Dial/tls.Dial in gircclient's ServerConnection.Connect.
+func dial(address string, useTLS bool, tlsConfig *tls.Config, module Module) (net.Conn, error) {
+	conn, err := dialTCP(address, module)
+	if err != nil {
+		return nil, err
+	}
+	if !useTLS {
+		return conn, nil
+	}
+	tlsConn, err := handshake(conn, tlsConfig, module)
+	if err != nil {
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialTCP makes the plain TCP connection to address, through the module's
+// proxy if it has one, and sends the module's PROXY protocol header. An
+// address that is an absolute path is dialled as a Unix domain socket,
+// directly.
+func dialTCP(address string, module Module) (net.Conn, error) {
+	var conn net.Conn
+	if filepath.IsAbs(address) {
+		var err error
+		if conn, err = net.DialTimeout("unix", address, module.Timeout); err != nil {
+			return nil, err
+		}
+	} else if module.ProxyURL != "" {
+		// validate has already checked the proxy URL parses
+		proxyURL, _ := url.Parse(module.ProxyURL)
+		proxied, err := dialProxy(proxyURL, address, module)
+		if err != nil {
+			return nil, err
+		}
+		conn = proxied
+	} else {
+		dialer := &net.Dialer{
+			Timeout:  module.Timeout,
+			Resolver: resolver(module),
+		}
+		if module.SourceIPAddress != "" {
+			dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(module.SourceIPAddress)}
+		}
+		var err error
+		if conn, err = dialer.Dial(dialNetwork(module), address); err != nil {
+			return nil, err
+		}
+	}
+
+	if module.ProxyProtocol.Version != 0 {
+		if err := writeProxyHeader(conn, address, module); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// handshake starts TLS on conn, closing conn if the handshake fails.
+func handshake(conn net.Conn, tlsConfig *tls.Config, module Module) (*tls.Conn, error) {
+	tlsConn := tls.Client(conn, tlsConfig)
+	tlsConn.SetDeadline(time.Now().Add(module.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialNetwork returns the network to dial for the module's
+// preferred_ip_protocol. "tcp" has Go try both protocols, falling back from
+// one to the other.
+func dialNetwork(module Module) string {
+	switch module.PreferredIPProtocol {
+	case "ip4":
+		return "tcp4"
+	case "ip6":
+		return "tcp6"
+	}
+	return "tcp"
+}
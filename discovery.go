@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// targetGroup is a group of targets in Prometheus' http_sd and file_sd
+// format.
+type targetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels,omitempty"`
+}
+
+// discoverer periodically lists the network's servers from a seed server
+// and serves them as Prometheus targets.
+type discoverer struct {
+	cfg    DiscoveryConfig
+	module Module
+
+	mu     sync.Mutex
+	groups []targetGroup
+}
+
+func newDiscoverer(cfg DiscoveryConfig, module Module) *discoverer {
+	return &discoverer{
+		cfg:    cfg,
+		module: module,
+		groups: []targetGroup{},
+	}
+}
+
+// run refreshes the targets every interval, forever.
+func (d *discoverer) run() {
+	for {
+		if err := d.refresh(); err != nil {
+			log.Printf("[ERROR] Could not discover servers from %s: %v", d.cfg.Seed, err)
+		}
+		time.Sleep(d.cfg.Interval)
+	}
+}
+
+func (d *discoverer) refresh() error {
+	seed, err := parseTarget(d.cfg.Seed)
+	if err != nil {
+		return err
+	}
+	p, err := connect(seed, targetAddress(seed), d.module, prometheus.NewRegistry())
+	if err != nil {
+		return err
+	}
+	defer p.close()
+	if err := p.register(); err != nil {
+		return err
+	}
+	servers, err := p.queryLinks(d.cfg.UseMap)
+	if err != nil {
+		return err
+	}
+
+	groups := d.targetGroups(servers)
+	d.mu.Lock()
+	d.groups = groups
+	d.mu.Unlock()
+
+	if d.cfg.File != "" {
+		return writeFileSD(d.cfg.File, groups)
+	}
+	return nil
+}
+
+// targetGroups maps each discovered server to its target, labelled with its
+// place in the network.
+func (d *discoverer) targetGroups(servers []linkedServer) []targetGroup {
+	uplinks := map[string]bool{}
+	for _, server := range servers {
+		if !strings.EqualFold(server.Uplink, server.Name) {
+			uplinks[strings.ToLower(server.Uplink)] = true
+		}
+	}
+
+	groups := []targetGroup{}
+	for _, server := range servers {
+		target := d.target(server.Name)
+		if target == "" {
+			continue
+		}
+
+		role := "leaf"
+		if uplinks[strings.ToLower(server.Name)] {
+			role = "hub"
+		}
+		labels := map[string]string{
+			"server": server.Name,
+			"role":   role,
+		}
+		if server.Uplink != "" {
+			labels["uplink"] = server.Uplink
+		}
+		if server.Hops >= 0 {
+			labels["hops"] = strconv.Itoa(server.Hops)
+		}
+		groups = append(groups, targetGroup{Targets: []string{target}, Labels: labels})
+	}
+	return groups
+}
+
+// target returns the target for a server name, or "" if it is excluded.
+func (d *discoverer) target(name string) string {
+	for _, excluded := range d.cfg.Exclude {
+		if strings.EqualFold(excluded, name) {
+			return ""
+		}
+	}
+	for server, target := range d.cfg.Targets {
+		if strings.EqualFold(server, name) {
+			return target
+		}
+	}
+	return strings.Replace(d.cfg.TargetTemplate, "{server}", name, -1)
+}
+
+// targets returns every currently discovered target.
+func (d *discoverer) targets() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var targets []string
+	for _, group := range d.groups {
+		targets = append(targets, group.Targets...)
+	}
+	return targets
+}
+
+// ServeHTTP serves the latest targets in http_sd format.
+func (d *discoverer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	groups := d.groups
+	d.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groups)
+}
+
+// writeFileSD atomically replaces path with groups, so Prometheus never
+// reads a partially written file.
+func writeFileSD(path string, groups []targetGroup) error {
+	data, err := json.MarshalIndent(groups, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	// TempFile creates files only we can read, but Prometheus may run as
+	// another user
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// resolver returns the resolver the module's DNS lookups should use.
+func resolver(module Module) *net.Resolver {
+	if module.DNS.Resolver == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, module.DNS.Resolver)
+		},
+	}
+}
+
+// labelledProbe is one of several probes run for a single target, whose
+// metrics are told apart by labels.
+type labelledProbe struct {
+	tgt     *url.URL
+	address string
+	labels  map[string]string
+}
+
+// probeEach runs each probe in parallel, with its own registry, and returns
+// a Gatherer merging their labelled metrics with registry's.
+func probeEach(probes []labelledProbe, module Module, registry *prometheus.Registry) prometheus.Gatherer {
+	gatherers := prometheus.Gatherers{registry}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for _, lp := range probes {
+		wg.Add(1)
+		go func(lp labelledProbe) {
+			defer wg.Done()
+			probeRegistry := prometheus.NewRegistry()
+			probe(lp.tgt, lp.address, module, probeRegistry)
+
+			mu.Lock()
+			gatherers = append(gatherers, withLabels(probeRegistry, lp.labels))
+			mu.Unlock()
+		}(lp)
+	}
+	wg.Wait()
+
+	return gatherers
+}
+
+// probeAllAddresses resolves tgt's hostname and probes each address it
+// resolves to, labelling each one's metrics with the address and its family.
+func probeAllAddresses(tgt *url.URL, module Module, registry *prometheus.Registry) prometheus.Gatherer {
+	records := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_dns_records",
+		Help: "number of addresses the target's hostname resolves to",
+	}, []string{"family"})
+	lookupDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_dns_lookup_duration_seconds",
+		Help: "time taken to resolve the target's hostname",
+	})
+	registry.MustRegister(records, lookupDuration)
+	records.WithLabelValues("ip4").Set(0)
+	records.WithLabelValues("ip6").Set(0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	start := time.Now()
+	addrs, err := resolver(module).LookupIPAddr(ctx, tgt.Hostname())
+	lookupDuration.Set(time.Since(start).Seconds())
+	if err != nil {
+		log.Printf("[ERROR] Could not resolve %s: %v", tgt.Hostname(), err)
+		return registry
+	}
+
+	_, port, _ := net.SplitHostPort(targetAddress(tgt))
+	var probes []labelledProbe
+	for _, addr := range addrs {
+		family := ipFamily(addr.IP)
+		records.WithLabelValues(family).Inc()
+		if preferred := module.PreferredIPProtocol; (preferred == "ip4" || preferred == "ip6") && preferred != family {
+			continue
+		}
+		probes = append(probes, labelledProbe{
+			tgt:     tgt,
+			address: net.JoinHostPort(addr.IP.String(), port),
+			labels: map[string]string{
+				"address":   addr.IP.String(),
+				"ip_family": family,
+			},
+		})
+	}
+	return probeEach(probes, module, registry)
+}
+
+// probeSRV looks up the _irc._tcp or _ircs._tcp SRV records of an irc+srv
+// or ircs+srv target and probes the servers they point to. Only the record a
+// client would try first is probed unless the module asks for all of them.
+func probeSRV(tgt *url.URL, module Module, registry *prometheus.Registry) prometheus.Gatherer {
+	records := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_srv_records",
+		Help: "number of SRV records for the target's domain",
+	})
+	lookupDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_srv_lookup_duration_seconds",
+		Help: "time taken to look up the target's SRV records",
+	})
+	unavailable := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_srv_service_unavailable",
+		Help: "target's domain has an SRV record of \".\", saying the service is not available there",
+	})
+	registry.MustRegister(records, lookupDuration, unavailable)
+
+	service := strings.TrimSuffix(tgt.Scheme, "+srv")
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	start := time.Now()
+	// LookupSRV orders the records by priority, shuffled by weight
+	_, srvs, err := resolver(module).LookupSRV(ctx, service, "tcp", tgt.Hostname())
+	lookupDuration.Set(time.Since(start).Seconds())
+	if err != nil {
+		log.Printf("[ERROR] Could not look up SRV records for %s: %v", tgt.Hostname(), err)
+		return registry
+	}
+	records.Set(float64(len(srvs)))
+
+	// a target of "." says the service is decidedly not available at the
+	// domain (RFC 2782), rather than being a host to dial
+	var available []*net.SRV
+	for _, srv := range srvs {
+		if srv.Target == "." || srv.Target == "" {
+			unavailable.Set(1)
+			continue
+		}
+		available = append(available, srv)
+	}
+	srvs = available
+
+	if !module.DNS.SRVProbeAll && len(srvs) > 1 {
+		srvs = srvs[:1]
+	}
+	var probes []labelledProbe
+	for _, srv := range srvs {
+		address := net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		probes = append(probes, labelledProbe{
+			tgt:     &url.URL{Scheme: service, Host: address},
+			address: address,
+			labels: map[string]string{
+				"srv_target": address,
+				"priority":   strconv.Itoa(int(srv.Priority)),
+				"weight":     strconv.Itoa(int(srv.Weight)),
+			},
+		})
+	}
+	return probeEach(probes, module, registry)
+}
+
+// ipFamily returns "ip4" or "ip6", as used in ip_family labels.
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "ip4"
+	}
+	return "ip6"
+}
+
+// withLabels returns a Gatherer that adds labels to every metric g gathers.
+func withLabels(g prometheus.Gatherer, labels map[string]string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				for name, value := range labels {
+					m.Label = append(m.Label, &dto.LabelPair{
+						Name:  proto.String(name),
+						Value: proto.String(value),
+					})
+				}
+			}
+		}
+		return mfs, err
+	})
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// identKey identifies one of our connections the way an ident (RFC 1413)
+// query does.
+type identKey struct {
+	localPort  int
+	remoteIP   string
+	remotePort int
+}
+
+type identEntry struct {
+	username string
+	queried  bool
+}
+
+// identd answers ident queries for the probes' own connections.
+type identd struct {
+	mu    sync.Mutex
+	conns map[identKey]*identEntry
+}
+
+func newIdentd() *identd {
+	return &identd{conns: map[identKey]*identEntry{}}
+}
+
+// serve answers queries on l until it is closed.
+func (d *identd) serve(l net.Listener) {
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			// back off like net/http's server does, so running out of file
+			// descriptors doesn't turn into a busy loop of log lines
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			log.Printf("[ERROR] identd could not accept connection, retrying in %v: %v", delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		go d.handle(conn)
+	}
+}
+
+func (d *identd) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+	// the query is "<port on our side>, <port on the querier's side>"
+	ports := strings.Split(strings.TrimSpace(line), ",")
+	if len(ports) != 2 {
+		return
+	}
+	localPort, err1 := strconv.Atoi(strings.TrimSpace(ports[0]))
+	remotePort, err2 := strconv.Atoi(strings.TrimSpace(ports[1]))
+	if err1 != nil || err2 != nil {
+		fmt.Fprintf(conn, "%s : ERROR : INVALID-PORT\r\n", strings.TrimSpace(line))
+		return
+	}
+
+	key := identKey{localPort: localPort, remoteIP: remote.IP.String(), remotePort: remotePort}
+	entry, ok := d.lookup(key)
+
+	if !ok {
+		fmt.Fprintf(conn, "%d , %d : ERROR : NO-USER\r\n", localPort, remotePort)
+		return
+	}
+	fmt.Fprintf(conn, "%d , %d : USERID : UNIX : %s\r\n", localPort, remotePort, entry.username)
+}
+
+// lookup finds the connection a query is for and marks it queried. Servers
+// can query us before the probe has had a chance to add a connection it just
+// made, so this waits a little for one to show up.
+func (d *identd) lookup(key identKey) (*identEntry, bool) {
+	for wait := time.Second; ; wait -= 10 * time.Millisecond {
+		d.mu.Lock()
+		entry, ok := d.conns[key]
+		if ok {
+			entry.queried = true
+		}
+		d.mu.Unlock()
+		if ok || wait <= 0 {
+			return entry, ok
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// add answers queries for conn with username until it's removed. Only TCP
+// connections can be looked up.
+func (d *identd) add(conn net.Conn, username string) (identKey, bool) {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return identKey{}, false
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return identKey{}, false
+	}
+	key := identKey{localPort: local.Port, remoteIP: remote.IP.String(), remotePort: remote.Port}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.conns[key] = &identEntry{username: username}
+	return key, true
+}
+
+// remove stops answering queries for a connection.
+func (d *identd) remove(key identKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.conns, key)
+}
+
+// wasQueried reports whether the connection has been queried so far.
+func (d *identd) wasQueried(key identKey) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entry, ok := d.conns[key]
+	return ok && entry.queried
+}
+
+// probeIdent exports whether the server queried our identd while we
+// registered, and whether it used the reply: servers prefix the username
+// with "~" when they couldn't get one.
+func probeIdent(p *ircProbe) {
+	queried := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_ident_queried",
+		Help: "server sent an ident query for the probe connection",
+	})
+	used := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_ident_used",
+		Help: "server registered the probe with the username from the ident reply",
+	})
+	p.registry.MustRegister(queried, used)
+
+	if p.ident != nil && identServer.wasQueried(*p.ident) {
+		queried.Set(1)
+	}
+	if p.user != "" && !strings.HasPrefix(p.user, "~") {
+		used.Set(1)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// failingListener fails every Accept with err until it is closed.
+type failingListener struct {
+	net.Listener
+	err     error
+	accepts int
+	closed  chan struct{}
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	select {
+	case <-l.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+	l.accepts++
+	return nil, l.err
+}
+
+func TestIdentdServeBacksOff(t *testing.T) {
+	l := &failingListener{err: errors.New("too many open files"), closed: make(chan struct{})}
+	served := make(chan struct{})
+	go func() {
+		newIdentd().serve(l)
+		close(served)
+	}()
+
+	// 5ms, 10ms, 20ms, 40ms, 80ms... leaves room for a handful of retries
+	time.Sleep(100 * time.Millisecond)
+	close(l.closed)
+	select {
+	case <-served:
+	case <-time.After(3 * time.Second):
+		t.Fatal("serve() kept running after its listener was closed")
+	}
+	if l.accepts > 10 {
+		t.Errorf("serve() called Accept %d times in 100ms, want it to back off", l.accepts)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mapServerRegexp finds the server name in a MAP line such as
+// "|-leaf.example.net[00B] ----- | Users: 12 (20.0%)".
+var mapServerRegexp = regexp.MustCompile(`[A-Za-z0-9][A-Za-z0-9-]*(\.[A-Za-z0-9-]+)+`)
+
+// linkedServer is one server the network reports in LINKS or MAP. Servers
+// only seen in MAP have no Uplink and a Hops of -1.
+type linkedServer struct {
+	Name        string
+	Uplink      string
+	Hops        int
+	Description string
+}
+
+// probeLinks exports the network's topology and whether each expected server
+// is linked to it.
+func probeLinks(p *ircProbe, cfg LinksConfig) {
+	linkInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_link_info",
+		Help: "server linked to the network, as reported by LINKS or MAP",
+	}, []string{"server", "uplink", "hops", "description"})
+	serversTotal := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_network_servers_total",
+		Help: "number of servers linked to the network",
+	})
+	expectedLinked := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_expected_server_linked",
+		Help: "expected server is linked to the network",
+	}, []string{"server"})
+	p.registry.MustRegister(linkInfo, serversTotal, expectedLinked)
+	for _, server := range cfg.ExpectedServers {
+		expectedLinked.WithLabelValues(server).Set(0)
+	}
+
+	servers, err := p.queryLinks(cfg.UseMap)
+	if err != nil {
+		log.Printf("[ERROR] Could not list network links: %v", err)
+		return
+	}
+
+	serversTotal.Set(float64(len(servers)))
+	for _, server := range servers {
+		hops := ""
+		if server.Hops >= 0 {
+			hops = strconv.Itoa(server.Hops)
+		}
+		linkInfo.WithLabelValues(server.Name, server.Uplink, hops, server.Description).Set(1)
+		for _, expected := range cfg.ExpectedServers {
+			if strings.EqualFold(expected, server.Name) {
+				expectedLinked.WithLabelValues(expected).Set(1)
+			}
+		}
+	}
+}
+
+// queryLinks returns the servers listed by LINKS and, if useMap is set, any
+// further ones listed by MAP.
+func (p *ircProbe) queryLinks(useMap bool) ([]linkedServer, error) {
+	var servers []linkedServer
+	seen := map[string]bool{}
+
+	p.send("LINKS")
+	_, err := p.expectReply(func(msg ircmsg.IrcMessage) bool {
+		if isCommand("364")(msg) && len(msg.Params) >= 4 {
+			// <me> <server> <uplink> :<hops> <description>
+			server := linkedServer{Name: msg.Params[1], Uplink: msg.Params[2], Hops: -1}
+			info := strings.SplitN(msg.Params[3], " ", 2)
+			if hops, err := strconv.Atoi(info[0]); err == nil {
+				server.Hops = hops
+			}
+			if len(info) > 1 {
+				server.Description = info[1]
+			}
+			if !seen[strings.ToLower(server.Name)] {
+				seen[strings.ToLower(server.Name)] = true
+				servers = append(servers, server)
+			}
+		}
+		return isCommand("365")(msg)
+	}, isCommand("481"))
+	if err != nil {
+		return nil, err
+	}
+
+	if !useMap {
+		return servers, nil
+	}
+
+	// RPL_MAP and RPL_MAPEND are 015/017 on most ircds, 006/007 on others
+	p.send("MAP")
+	_, err = p.expectReply(func(msg ircmsg.IrcMessage) bool {
+		if isCommand("015", "006")(msg) && len(msg.Params) >= 2 {
+			name := mapServerRegexp.FindString(stripFormatting(msg.Params[len(msg.Params)-1]))
+			if name != "" && !seen[strings.ToLower(name)] {
+				seen[strings.ToLower(name)] = true
+				servers = append(servers, linkedServer{Name: name, Hops: -1})
+			}
+		}
+		return isCommand("017", "007")(msg)
+	}, isCommand("421", "481"))
+	if err != nil {
+		log.Printf("[WARN] MAP failed, using LINKS output only: %v", err)
+	}
+	return servers, nil
+}
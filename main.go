@@ -1,26 +1,66 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 
+	"github.com/DanielOaks/go-idn/idna2003"
+	"github.com/DanielOaks/go-idn/idna2003/punycode"
 	gircclient "github.com/goshuirc/irc-go/client"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+var (
+	configFile    = flag.String("config.file", "", "path to the module configuration file")
+	listenAddress = flag.String("web.listen-address", ":8080", "address to serve probes on")
+	identdAddress = flag.String("identd.listen-address", "", "address to answer ident queries for probe connections on, usually :113 (disabled if empty)")
+
+	config *Config
+	// discovery is the running discoverer, if discovery is configured.
+	discovery *discoverer
+	// identServer answers ident queries, if an identd address is set.
+	identServer *identd
+)
+
 func init() {
 	rand.Seed(time.Now().UnixNano())
 }
 
 func main() {
+	flag.Parse()
+
+	var err error
+	config, err = loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("[ERROR] Could not load config: %v", err)
+	}
+
+	if *identdAddress != "" {
+		l, err := net.Listen("tcp", *identdAddress)
+		if err != nil {
+			log.Fatalf("[ERROR] Could not listen for ident queries: %v", err)
+		}
+		identServer = newIdentd()
+		go identServer.serve(l)
+	}
+
 	http.Handle("/probe", http.HandlerFunc(probeHandler))
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	http.Handle("/probe_network", http.HandlerFunc(probeNetworkHandler))
+	if config.Discovery.Seed != "" {
+		discovery = newDiscoverer(config.Discovery, config.Modules[config.Discovery.Module])
+		go discovery.run()
+		http.Handle("/discovery", discovery)
+	}
+	log.Fatal(http.ListenAndServe(*listenAddress, nil))
 }
 
 func probeHandler(w http.ResponseWriter, r *http.Request) {
@@ -31,55 +71,267 @@ func probeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tgt, err := url.Parse(target)
+	tgt, err := parseTarget(target)
 	if err != nil {
 		w.WriteHeader(400)
-		w.Write([]byte("invalid target; not valid uri"))
+		w.Write([]byte(err.Error()))
 		return
 	}
-	if tgt.Scheme != "ircs" && tgt.Scheme != "irc" {
+
+	module, err := lookupModule(r.URL.Query().Get("module"))
+	if err != nil {
 		w.WriteHeader(400)
-		w.Write([]byte("target must have ircs or irc scheme"))
+		w.Write([]byte(err.Error()))
 		return
 	}
 	// TODO: prometheus timeout header
 
 	registry := prometheus.NewRegistry()
+	targetInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_target_info",
+		Help: "target hostname, in both punycode and unicode form",
+	}, []string{"hostname", "hostname_unicode"})
+	registry.MustRegister(targetInfo)
+	targetInfo.WithLabelValues(tgt.Hostname(), unicodeHostname(tgt.Hostname())).Set(1)
 
-	up := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "irc_up",
-		Help: "target irc server is up",
-	})
-	registry.MustRegister(up)
+	var gatherer prometheus.Gatherer = registry
+	if isSRV(tgt) {
+		gatherer = probeSRV(tgt, module, registry)
+	} else if module.DNS.ProbeAllAddresses && !isUnix(tgt) {
+		gatherer = probeAllAddresses(tgt, module, registry)
+	} else {
+		probe(tgt, targetAddress(tgt), module, registry)
+	}
+	promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
 
-	reactor := gircclient.NewReactor()
-	defer reactor.Shutdown("probe done")
+// lookupModule returns the named module, or the default module if name is
+// empty.
+func lookupModule(name string) (Module, error) {
+	if name == "" {
+		name = defaultModuleName
+	}
+	module, ok := config.Modules[name]
+	if !ok {
+		return Module{}, fmt.Errorf("unknown module %q", name)
+	}
+	return module, nil
+}
+
+// parseTarget parses and checks a target URI.
+func parseTarget(target string) (*url.URL, error) {
+	tgt, err := url.Parse(target)
+	if err != nil {
+		return nil, errors.New("invalid target; not valid uri")
+	}
+	switch tgt.Scheme {
+	case "irc", "ircs", "irc+srv", "ircs+srv", "irc+starttls", "ws", "wss":
+	case "irc+unix", "ircs+unix":
+		if tgt.Path == "" {
+			return nil, errors.New("unix socket target has no path")
+		}
+	default:
+		return nil, errors.New("target must have irc, ircs, irc+srv, ircs+srv, irc+starttls, ws, wss, irc+unix or ircs+unix scheme")
+	}
+
+	// everything from dialing to SNI wants the punycode form of an
+	// internationalized hostname
+	host, err := asciiHostname(tgt.Hostname())
+	if err != nil {
+		return nil, fmt.Errorf("invalid target hostname: %v", err)
+	}
+	if host != tgt.Hostname() {
+		if port := tgt.Port(); port != "" {
+			host = net.JoinHostPort(host, port)
+		}
+		tgt.Host = host
+	}
+	return tgt, nil
+}
+
+// asciiHostname converts an internationalized hostname to punycode. ASCII
+// hostnames, including IP addresses, are returned unchanged.
+func asciiHostname(host string) (string, error) {
+	ascii := true
+	for i := 0; i < len(host); i++ {
+		if host[i] > 127 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return host, nil
+	}
+
+	// idna2003 keeps the ideographic full stops it splits labels on
+	host = strings.NewReplacer("\u3002", ".", "\uff0e", ".", "\uff61", ".").Replace(host)
+	fqdn := strings.HasSuffix(host, ".")
+	host, err := idna2003.ToASCII(strings.TrimSuffix(host, "."))
+	if err != nil {
+		return "", err
+	}
+	if fqdn {
+		host += "."
+	}
+	return host, nil
+}
+
+// unicodeHostname converts a punycode hostname back to its Unicode form for
+// display. Labels that aren't valid punycode are left as they are.
+func unicodeHostname(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if !strings.HasPrefix(strings.ToLower(label), idna2003.AcePrefix) {
+			continue
+		}
+		// idna2003.ToUnicode fails on any label that isn't punycode, so
+		// decode the labels ourselves
+		if decoded, err := punycode.DecodeString(label[len(idna2003.AcePrefix):]); err == nil {
+			labels[i] = decoded
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// isSRV reports whether tgt names a domain whose SRV records list the
+// servers to probe, rather than a server itself.
+func isSRV(tgt *url.URL) bool {
+	return strings.HasSuffix(tgt.Scheme, "+srv")
+}
+
+// isUnix reports whether tgt names a Unix domain socket by its path.
+func isUnix(tgt *url.URL) bool {
+	return strings.HasSuffix(tgt.Scheme, "+unix")
+}
+
+// targetAddress returns the host:port to dial for tgt, filling in the
+// standard port for its scheme if it has none. For Unix socket targets it is
+// the socket's path.
+func targetAddress(tgt *url.URL) string {
+	if isUnix(tgt) {
+		return tgt.Path
+	}
+	if tgt.Port() != "" {
+		return tgt.Host
+	}
+	switch tgt.Scheme {
+	case "ircs":
+		return net.JoinHostPort(tgt.Hostname(), "6697")
+	case "ws":
+		return net.JoinHostPort(tgt.Hostname(), "80")
+	case "wss":
+		return net.JoinHostPort(tgt.Hostname(), "443")
+	}
+	return net.JoinHostPort(tgt.Hostname(), "6667")
+}
+
+// connect dials address for tgt with the module's settings and starts
+// reading from the connection. The returned probe must be closed once the
+// caller is done.
+func connect(tgt *url.URL, address string, module Module, registry *prometheus.Registry) (*ircProbe, error) {
+	// a bare reactor, without the handlers gircclient registers by default:
+	// those only send NICK and USER once the server ACKs or NAKs a cap we
+	// asked for, so servers without CAP, or without any cap we want, would
+	// never register us. newIRCProbe registers its own instead.
+	reactor := gircclient.Reactor{ServerConnections: map[string]*gircclient.ServerConnection{}}
 
 	server := reactor.CreateServer("probe")
-	server.InitialNick = fmt.Sprintf("promirc_%s", rand.Int31())
-	server.InitialUser = "promirc"
+	server.InitialNick = fmt.Sprintf("%s%d", module.NickPrefix, rand.Int31())
+	server.InitialUser = module.User
+	server.InitialRealName = module.RealName
+	if module.Services.Enabled && module.Services.UseAccountRegistration {
+		server.Caps.AddWantedCaps(accountRegistrationCap)
+	}
+
+	tlsConfig, err := newTLSConfig(tgt, module)
+	if err != nil {
+		return nil, err
+	}
 
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true,
+	p := newIRCProbe(server, registry, module)
+	var conn net.Conn
+	switch tgt.Scheme {
+	case "irc+starttls":
+		conn, err = dialStartTLS(address, tlsConfig, module, registry)
+	case "ws", "wss":
+		conn, err = dialWebSocket(tgt, address, tlsConfig, module, registry)
+	default:
+		conn, err = dial(address, tgt.Scheme == "ircs" || tgt.Scheme == "ircs+unix", tlsConfig, module)
+	}
+	if err != nil {
+		p.close()
+		return nil, err
 	}
+	p.connected = true
+	p.connectedAt = time.Now()
+	if identServer != nil {
+		// the server looks us up as soon as we connect, so this has to
+		// happen before we send anything
+		if key, ok := identServer.add(conn, module.User); ok {
+			p.ident = &key
+		}
+	}
+
+	ipProtocol := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_ip_protocol",
+		Help: "ip protocol version used to connect to the target",
+	})
+	registry.MustRegister(ipProtocol)
+	if proxied, ok := proxiedConn(conn); ok {
+		// we only know how we reached the proxy, not how it reached the
+		// target
+		proxyConnectDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "irc_proxy_connect_duration_seconds",
+			Help: "time taken to connect to the target through the proxy",
+		})
+		registry.MustRegister(proxyConnectDuration)
+		proxyConnectDuration.Set(proxied.connectDuration.Seconds())
+	} else if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		if ipFamily(addr.IP) == "ip4" {
+			ipProtocol.Set(4)
+		} else {
+			ipProtocol.Set(6)
+		}
+	}
+
+	// the rest of what gircclient's ServerConnection.Connect does
+	server.RawConnection = conn
+	server.Connected = true
+	// WEBIRC has to come before anything else we send
+	if module.WebIRC.Password != "" {
+		p.send("WEBIRC", module.WebIRC.Password, module.WebIRC.Gateway, module.WebIRC.Hostname, module.WebIRC.IP)
+	}
+	// like other IRCv3 clients, register straight away: the server holds
+	// registration until CAP END if it supports CAP, and ignores CAP LS if
+	// it doesn't
+	server.Send(nil, "", "CAP", "LS", "302")
+	server.Nick = server.InitialNick
+	p.send("NICK", server.InitialNick)
+	p.send("USER", server.InitialUser, "0", "*", server.InitialRealName)
+	go server.ReceiveLoop()
+
+	return p, nil
+}
+
+func probe(tgt *url.URL, address string, module Module, registry *prometheus.Registry) {
+	up := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_up",
+		Help: "target irc server is up",
+	})
+	registry.MustRegister(up)
 
-	err = server.Connect(
-		tgt.Host,
-		tgt.Scheme == "ircs",
-		tlsConfig,
-	)
+	p, err := connect(tgt, address, module, registry)
 	if err != nil {
 		log.Printf("[ERROR] Could not connect to target: %v", err)
-		promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
 		return
 	}
+	defer p.close()
+	// before close, so the ERROR answering our QUIT isn't counted
+	defer probeServerErrors(p)
 
-	// TODO timeout; implement this ourselves
-	server.WaitForConnection()
 	up.Inc()
 
-	if tgt.Scheme == "ircs" {
-		state := server.RawConnection.(*tls.Conn).ConnectionState()
+	if state, ok := tlsConnectionState(p.server.RawConnection); ok {
 		tlsExpiryGauge := prometheus.NewGauge(prometheus.GaugeOpts{
 			Name: "irc_ssl_expiry_epoch_seconds",
 			Help: "ssl expiry in unixtime, or zero for error",
@@ -96,7 +348,81 @@ func probeHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		tlsExpiryGauge.Set(float64(earliest.Unix()))
+
+		probeLeafSPKI(state, module, registry)
+		probeOCSP(state, module, registry)
+		if module.TLS.DANE {
+			probeDANE(tgt.Hostname(), address, state, module, registry)
+		}
+		if module.TLS.Audit {
+			auditTLS(tgt, address, module, registry)
+		}
+		if module.TLS.CheckResumption {
+			probeResumption(tgt, address, module, registry)
+		}
+	}
+
+	stsAdvertised := false
+	if tgt.Scheme == "irc" && module.STS.Enabled {
+		stsAdvertised = probeSTS(p, tgt, address)
 	}
 
-	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	if !module.needsRegistration() {
+		// still hear the server out, so that being throttled or banned,
+		// which it tells us in reply to NICK and USER, shows up in
+		// irc_server_error_info
+		p.expect(module.Timeout, isCommand("001", "ERROR"))
+		return
+	}
+
+	registered := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_registered",
+		Help: "probe completed irc registration",
+	})
+	registrationDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_registration_duration_seconds",
+		Help: "time taken to complete irc registration",
+	})
+	registry.MustRegister(registered, registrationDuration)
+
+	start := time.Now()
+	err = p.register()
+	if module.AuthNotices.Enabled {
+		probeAuthNotices(p, module.AuthNotices)
+	}
+	if tgt.Scheme == "irc" && module.STS.RequireOnPlaintext {
+		_, refused := err.(refusedError)
+		probeSTSPolicy(registry, stsAdvertised, refused)
+	}
+	if err != nil {
+		log.Printf("[ERROR] Could not register with target: %v", err)
+		return
+	}
+	registered.Set(1)
+	registrationDuration.Set(time.Since(start).Seconds())
+
+	if module.ProxyProtocol.Version != 0 {
+		p.checkHost("irc_proxy_protocol_host_match", "server reported the host the proxy protocol header claimed",
+			module.ProxyProtocol.expectedHost())
+	}
+	if module.WebIRC.Password != "" {
+		p.checkHost("irc_webirc_host_match", "server reported the host sent with webirc",
+			module.WebIRC.expectedHost())
+	}
+	if identServer != nil {
+		probeIdent(p)
+	}
+
+	if module.Services.Enabled {
+		probeServices(p, module.Services)
+	}
+	if len(module.ChannelAccess.Channels) > 0 {
+		probeChannelAccess(p, module.ChannelAccess)
+	}
+	if module.Oper.Name != "" {
+		probeOper(p, module.Oper)
+	}
+	if module.Links.Enabled {
+		probeLinks(p, module.Links)
+	}
 }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// networkAttributes are the server attributes compared across a network.
+var networkAttributes = []string{"version", "isupport", "cap_ls", "motd", "tls_fingerprint"}
+
+func probeNetworkHandler(w http.ResponseWriter, r *http.Request) {
+	module, err := lookupModule(r.URL.Query().Get("module"))
+	if err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	targets := r.URL.Query()["target"]
+	if len(targets) == 0 && discovery != nil {
+		targets = discovery.targets()
+	}
+	if len(targets) == 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("no targets provided and none discovered"))
+		return
+	}
+
+	var tgts []*url.URL
+	for _, target := range targets {
+		tgt, err := parseTarget(target)
+		if err == nil && isSRV(tgt) {
+			err = errors.New("SRV targets are only supported by /probe")
+		}
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(fmt.Sprintf("%s: %v", target, err)))
+			return
+		}
+		tgts = append(tgts, tgt)
+	}
+
+	registry := prometheus.NewRegistry()
+	probeNetwork(tgts, module, registry)
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probeNetwork probes every target in parallel and reports, for each of the
+// networkAttributes, whether all reachable servers agree on its value.
+func probeNetwork(tgts []*url.URL, module Module, registry *prometheus.Registry) {
+	serverUp := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_network_server_up",
+		Help: "server was reachable and completed registration",
+	}, []string{"server"})
+	consistent := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_network_consistent",
+		Help: "all reachable servers agree on an attribute",
+	}, []string{"attribute"})
+	divergent := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_network_server_divergent",
+		Help: "server's attribute differs from the value most servers have",
+	}, []string{"server", "attribute"})
+	attributeInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_network_attribute_info",
+		Help: "hash of a server's attribute value, to see which servers agree",
+	}, []string{"server", "attribute", "hash"})
+	registry.MustRegister(serverUp, consistent, divergent, attributeInfo)
+
+	results := make([]map[string]string, len(tgts))
+	var wg sync.WaitGroup
+	for i, tgt := range tgts {
+		wg.Add(1)
+		go func(i int, tgt *url.URL) {
+			defer wg.Done()
+			attributes, err := serverAttributes(tgt, module)
+			if err != nil {
+				log.Printf("[ERROR] Could not probe %s: %v", tgt, err)
+				return
+			}
+			results[i] = attributes
+		}(i, tgt)
+	}
+	wg.Wait()
+
+	for _, attribute := range networkAttributes {
+		counts := map[string]int{}
+		for _, attributes := range results {
+			if value, ok := attributes[attribute]; ok {
+				counts[value]++
+			}
+		}
+		if len(counts) == 0 {
+			continue
+		}
+		majority, best := "", 0
+		for value, count := range counts {
+			if count > best || (count == best && value < majority) {
+				majority, best = value, count
+			}
+		}
+
+		if len(counts) == 1 {
+			consistent.WithLabelValues(attribute).Set(1)
+		} else {
+			consistent.WithLabelValues(attribute).Set(0)
+		}
+		for i, attributes := range results {
+			value, ok := attributes[attribute]
+			if !ok {
+				continue
+			}
+			server := tgts[i].String()
+			attributeInfo.WithLabelValues(server, attribute, valueHash(value)).Set(1)
+			if value == majority {
+				divergent.WithLabelValues(server, attribute).Set(0)
+			} else {
+				divergent.WithLabelValues(server, attribute).Set(1)
+			}
+		}
+	}
+
+	for i, tgt := range tgts {
+		if results[i] != nil {
+			serverUp.WithLabelValues(tgt.String()).Set(1)
+		} else {
+			serverUp.WithLabelValues(tgt.String()).Set(0)
+		}
+	}
+}
+
+// serverAttributes registers with tgt and returns the values of the
+// networkAttributes it reports.
+func serverAttributes(tgt *url.URL, module Module) (map[string]string, error) {
+	p, err := connect(tgt, targetAddress(tgt), module, prometheus.NewRegistry())
+	if err != nil {
+		return nil, err
+	}
+	defer p.close()
+	if err := p.register(); err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{
+		"motd": strings.Join(p.motd, "\n"),
+	}
+
+	var isupport []string
+	for name, value := range p.server.Features {
+		isupport = append(isupport, fmt.Sprintf("%s=%v", name, value))
+	}
+	sort.Strings(isupport)
+	attributes["isupport"] = strings.Join(isupport, " ")
+
+	var caps []string
+	for name, value := range p.server.Caps.Available {
+		if value != nil {
+			name += "=" + *value
+		}
+		caps = append(caps, name)
+	}
+	sort.Strings(caps)
+	attributes["cap_ls"] = strings.Join(caps, " ")
+
+	if state, ok := tlsConnectionState(p.server.RawConnection); ok {
+		if len(state.PeerCertificates) > 0 {
+			attributes["tls_fingerprint"] = fmt.Sprintf("%x", sha256.Sum256(state.PeerCertificates[0].Raw))
+		}
+	}
+
+	p.send("VERSION")
+	msg, err := p.expectReply(isCommand("351"), isCommand("402", "481"))
+	if err != nil {
+		log.Printf("[ERROR] VERSION failed on %s: %v", tgt, err)
+	} else if len(msg.Params) > 1 {
+		attributes["version"] = msg.Params[1]
+	}
+
+	return attributes, nil
+}
+
+// valueHash shortens an attribute value for use as a label.
+func valueHash(value string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(value)))[:16]
+}
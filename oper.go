@@ -0,0 +1,231 @@
+package main
+
+import (
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// uptimeRegexp matches RPL_STATSUPTIME, e.g. "Server Up 12 days, 3:04:05".
+var uptimeRegexp = regexp.MustCompile(`(\d+) days?,? (\d+):(\d+):(\d+)`)
+
+// statsCollector turns STATS replies into metrics.
+type statsCollector struct {
+	registry *prometheus.Registry
+	// nick is our own nickname, whose client connection STATS l also lists
+	nick string
+
+	entries *prometheus.GaugeVec
+
+	uptime prometheus.Gauge
+
+	linkSendQ            *prometheus.GaugeVec
+	linkSentMessages     *prometheus.GaugeVec
+	linkSentBytes        *prometheus.GaugeVec
+	linkReceivedMessages *prometheus.GaugeVec
+	linkReceivedBytes    *prometheus.GaugeVec
+	linkAge              *prometheus.GaugeVec
+
+	commandCount       *prometheus.GaugeVec
+	commandBytes       *prometheus.GaugeVec
+	commandRemoteCount *prometheus.GaugeVec
+}
+
+func newStatsCollector(registry *prometheus.Registry, nick string) *statsCollector {
+	link := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, []string{"link"})
+	}
+	command := func(name, help string) *prometheus.GaugeVec {
+		return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, []string{"command"})
+	}
+
+	c := &statsCollector{
+		registry: registry,
+		nick:     nick,
+
+		entries: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_stats_entries",
+			Help: "number of lines returned by a STATS query",
+		}, []string{"query"}),
+		uptime: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "irc_stats_uptime_seconds",
+			Help: "server uptime from STATS u",
+		}),
+
+		linkSendQ:            link("irc_stats_link_sendq_bytes", "link sendq from STATS l"),
+		linkSentMessages:     link("irc_stats_link_sent_messages", "messages sent over a link from STATS l"),
+		linkSentBytes:        link("irc_stats_link_sent_bytes", "bytes sent over a link from STATS l"),
+		linkReceivedMessages: link("irc_stats_link_received_messages", "messages received over a link from STATS l"),
+		linkReceivedBytes:    link("irc_stats_link_received_bytes", "bytes received over a link from STATS l"),
+		linkAge:              link("irc_stats_link_age_seconds", "time a link has been open from STATS l"),
+
+		commandCount:       command("irc_stats_command_count", "times a command has been used from STATS m"),
+		commandBytes:       command("irc_stats_command_bytes", "bytes used by a command from STATS m"),
+		commandRemoteCount: command("irc_stats_command_remote_count", "times a command has been used remotely from STATS m"),
+	}
+	registry.MustRegister(c.entries)
+	return c
+}
+
+// probeOper opers up and runs each of the configured STATS queries.
+func probeOper(p *ircProbe, cfg OperConfig) {
+	opered := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_oper_success",
+		Help: "probe was granted operator status",
+	})
+	p.registry.MustRegister(opered)
+
+	params := []string{cfg.Name}
+	if cfg.Password != "" {
+		params = append(params, cfg.Password)
+	}
+	p.send("OPER", params...)
+	if _, err := p.expectReply(isCommand("381"), isCommand("464", "491")); err != nil {
+		log.Printf("[ERROR] Could not oper up as %s: %v", cfg.Name, err)
+		return
+	}
+	opered.Set(1)
+
+	c := newStatsCollector(p.registry, p.nick)
+	for _, query := range cfg.Stats {
+		if err := c.collect(p, query); err != nil {
+			log.Printf("[ERROR] STATS %s failed: %v", query, err)
+		}
+	}
+}
+
+// collect sends STATS query and records every reply up to RPL_ENDOFSTATS.
+func (c *statsCollector) collect(p *ircProbe, query string) error {
+	var replies []ircmsg.IrcMessage
+	p.send("STATS", query)
+	_, err := p.expectReply(func(msg ircmsg.IrcMessage) bool {
+		if isCommand("219")(msg) {
+			return true
+		}
+		// STATS replies are all 2xx numerics
+		if len(msg.Command) == 3 && msg.Command[0] == '2' {
+			replies = append(replies, msg)
+		}
+		return false
+	}, isCommand("481"))
+	if err != nil {
+		return err
+	}
+
+	c.entries.WithLabelValues(query).Set(float64(len(replies)))
+	for _, msg := range replies {
+		c.record(msg)
+	}
+	return nil
+}
+
+// record fills in the metrics for a STATS reply we know how to parse.
+func (c *statsCollector) record(msg ircmsg.IrcMessage) {
+	switch msg.Command {
+	case "242":
+		c.recordUptime(msg)
+	case "211":
+		c.recordLink(msg)
+	case "212":
+		c.recordCommand(msg)
+	}
+}
+
+func (c *statsCollector) recordUptime(msg ircmsg.IrcMessage) {
+	if len(msg.Params) == 0 {
+		return
+	}
+	match := uptimeRegexp.FindStringSubmatch(msg.Params[len(msg.Params)-1])
+	if match == nil {
+		return
+	}
+	var seconds float64
+	for i, unit := range []float64{86400, 3600, 60, 1} {
+		n, _ := strconv.Atoi(match[i+1])
+		seconds += float64(n) * unit
+	}
+	c.uptime.Set(seconds)
+	c.register(c.uptime)
+}
+
+// recordLink parses RPL_STATSLINKINFO, whose fields after the link name are
+// sendq, sent messages, sent KB, received messages, received KB and the
+// seconds the link has been open.
+func (c *statsCollector) recordLink(msg ircmsg.IrcMessage) {
+	fields := statsFields(msg)
+	if len(fields) < 7 {
+		return
+	}
+	link := fields[0]
+	if strings.HasPrefix(strings.ToLower(link), strings.ToLower(c.nick)+"[") {
+		return
+	}
+	values := parseFloats(fields[1:7])
+	c.linkSendQ.WithLabelValues(link).Set(values[0])
+	c.linkSentMessages.WithLabelValues(link).Set(values[1])
+	c.linkSentBytes.WithLabelValues(link).Set(values[2] * 1024)
+	c.linkReceivedMessages.WithLabelValues(link).Set(values[3])
+	c.linkReceivedBytes.WithLabelValues(link).Set(values[4] * 1024)
+	c.linkAge.WithLabelValues(link).Set(values[5])
+	c.register(c.linkSendQ, c.linkSentMessages, c.linkSentBytes,
+		c.linkReceivedMessages, c.linkReceivedBytes, c.linkAge)
+}
+
+// recordCommand parses RPL_STATSCOMMANDS, whose fields after the command
+// name are its use count and, on most ircds, byte and remote use counts.
+func (c *statsCollector) recordCommand(msg ircmsg.IrcMessage) {
+	fields := statsFields(msg)
+	if len(fields) < 2 {
+		return
+	}
+	command := fields[0]
+	values := parseFloats(fields[1:])
+	c.commandCount.WithLabelValues(command).Set(values[0])
+	c.register(c.commandCount)
+	if len(values) > 1 {
+		c.commandBytes.WithLabelValues(command).Set(values[1])
+		c.register(c.commandBytes)
+	}
+	if len(values) > 2 {
+		c.commandRemoteCount.WithLabelValues(command).Set(values[2])
+		c.register(c.commandRemoteCount)
+	}
+}
+
+// register adds metrics to the registry the first time a reply fills them
+// in, so queries that weren't run don't export empty metric families.
+func (c *statsCollector) register(collectors ...prometheus.Collector) {
+	for _, collector := range collectors {
+		if err := c.registry.Register(collector); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				log.Printf("[ERROR] Could not register STATS metric: %v", err)
+			}
+		}
+	}
+}
+
+// statsFields returns a STATS reply's parameters after our own nick, with a
+// trailing parameter split into words.
+func statsFields(msg ircmsg.IrcMessage) []string {
+	if len(msg.Params) == 0 {
+		return nil
+	}
+	var fields []string
+	for _, param := range msg.Params[1:] {
+		fields = append(fields, strings.Fields(param)...)
+	}
+	return fields
+}
+
+// parseFloats parses each field as a number, treating malformed ones as 0.
+func parseFloats(fields []string) []float64 {
+	values := make([]float64, len(fields))
+	for i, field := range fields {
+		values[i], _ = strconv.ParseFloat(field, 64)
+	}
+	return values
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestStatsCollectorRecord(t *testing.T) {
+	type gauge struct{ name, label string }
+	tests := []struct {
+		name  string
+		lines []string
+		want  map[gauge]map[string]float64
+	}{
+		{
+			name:  "STATS u",
+			lines: []string{":irc.example.net 242 promirc_1 :Server Up 12 days, 3:04:05"},
+			want: map[gauge]map[string]float64{
+				{"irc_stats_uptime_seconds", ""}: {"": 12*86400 + 3*3600 + 4*60 + 5},
+			},
+		},
+		{
+			name:  "STATS u a day up",
+			lines: []string{":irc.example.net 242 promirc_1 :Server Up 1 day 0:00:30"},
+			want: map[gauge]map[string]float64{
+				{"irc_stats_uptime_seconds", ""}: {"": 86400 + 30},
+			},
+		},
+		{
+			name: "STATS l",
+			lines: []string{
+				":irc.example.net 211 promirc_1 hub.example.net[@255.255.255.255] 0 1234 56 4321 65 :86400 3 TS GLN",
+				// our own client connection, which isn't a link
+				":irc.example.net 211 promirc_1 promirc_1[~promirc@127.0.0.1] 0 5 0 7 0 :2 0 -",
+			},
+			want: map[gauge]map[string]float64{
+				{"irc_stats_link_sendq_bytes", "link"}:       {"hub.example.net[@255.255.255.255]": 0},
+				{"irc_stats_link_sent_messages", "link"}:     {"hub.example.net[@255.255.255.255]": 1234},
+				{"irc_stats_link_sent_bytes", "link"}:        {"hub.example.net[@255.255.255.255]": 56 * 1024},
+				{"irc_stats_link_received_messages", "link"}: {"hub.example.net[@255.255.255.255]": 4321},
+				{"irc_stats_link_received_bytes", "link"}:    {"hub.example.net[@255.255.255.255]": 65 * 1024},
+				{"irc_stats_link_age_seconds", "link"}:       {"hub.example.net[@255.255.255.255]": 86400},
+			},
+		},
+		{
+			name: "STATS m",
+			lines: []string{
+				":irc.example.net 212 promirc_1 PRIVMSG 42 1337 :0",
+				// older ircds only count uses
+				":irc.example.net 212 promirc_1 PING 3",
+			},
+			want: map[gauge]map[string]float64{
+				{"irc_stats_command_count", "command"}:        {"PRIVMSG": 42, "PING": 3},
+				{"irc_stats_command_bytes", "command"}:        {"PRIVMSG": 1337},
+				{"irc_stats_command_remote_count", "command"}: {"PRIVMSG": 0},
+			},
+		},
+		{
+			name: "replies without params",
+			lines: []string{
+				":irc.example.net 242",
+				":irc.example.net 211",
+				":irc.example.net 212",
+			},
+		},
+	}
+	metrics := []gauge{
+		{"irc_stats_uptime_seconds", ""},
+		{"irc_stats_link_sendq_bytes", "link"},
+		{"irc_stats_link_sent_messages", "link"},
+		{"irc_stats_link_sent_bytes", "link"},
+		{"irc_stats_link_received_messages", "link"},
+		{"irc_stats_link_received_bytes", "link"},
+		{"irc_stats_link_age_seconds", "link"},
+		{"irc_stats_command_count", "command"},
+		{"irc_stats_command_bytes", "command"},
+		{"irc_stats_command_remote_count", "command"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			c := newStatsCollector(registry, "promirc_1")
+			for _, line := range test.lines {
+				msg, err := ircmsg.ParseLine(line)
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.record(msg)
+			}
+			// metrics a reply didn't fill in mustn't be exported at all
+			for _, metric := range metrics {
+				got := gaugeValues(t, registry, metric.name, metric.label)
+				want := test.want[metric]
+				if want == nil {
+					want = map[string]float64{}
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("%s = %v, want %v", metric.name, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goshuirc/eventmgr"
+	gircclient "github.com/goshuirc/irc-go/client"
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/goshuirc/irc-go/ircutils"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	errTimeout      = errors.New("timed out waiting for a reply")
+	errDisconnected = errors.New("server closed the connection")
+)
+
+// ircProbe drives a single connection to the target. Inbound lines are queued
+// so that checks can be written as a sequence of commands and the replies
+// they expect.
+type ircProbe struct {
+	server   *gircclient.ServerConnection
+	registry *prometheus.Registry
+	module   Module
+	deadline time.Time
+
+	// nick is the nickname the server assigned us in RPL_WELCOME.
+	nick string
+	// connected is set once the server connection is up.
+	connected bool
+	// motd holds the lines of the MOTD sent during registration.
+	motd []string
+	// host is the host the server reports for us, from RPL_WELCOME's
+	// nick!user@host or a later RPL_HOSTHIDDEN.
+	host string
+	// user is the username the server reports for us in RPL_WELCOME.
+	user string
+	// ident is our connection's entry with the identd, if it has one.
+	ident *identKey
+	// connectedAt is when the connection to the server was made.
+	connectedAt time.Time
+
+	// mu guards what the receive loop records for the probe below.
+	mu sync.Mutex
+	// authNotices holds the notices the server sent to AUTH or * before we
+	// registered, as they arrived.
+	authNotices []authNotice
+	// serverErrors holds the ERROR lines and ban numerics the server sent.
+	serverErrors []ircmsg.IrcMessage
+	// listedCaps holds the caps and values the server listed in its reply
+	// to CAP LS.
+	listedCaps map[string]string
+	// capLSEnded is set, and capLSDone closed, once the server has
+	// answered CAP LS, either with its last line or by showing it doesn't
+	// support CAP.
+	capLSEnded bool
+	capLSDone  chan struct{}
+
+	messages     chan ircmsg.IrcMessage
+	disconnected chan struct{}
+	done         chan struct{}
+}
+
+func newIRCProbe(server *gircclient.ServerConnection, registry *prometheus.Registry, module Module) *ircProbe {
+	p := &ircProbe{
+		server:       server,
+		registry:     registry,
+		module:       module,
+		deadline:     time.Now().Add(module.Timeout),
+		listedCaps:   map[string]string{},
+		capLSDone:    make(chan struct{}),
+		messages:     make(chan ircmsg.IrcMessage, 512),
+		disconnected: make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	server.RegisterEvent("in", "raw", p.rawHandler, 0)
+	server.RegisterEvent("in", "CAP", p.capHandler, 0)
+	server.RegisterEvent("in", "RPL_WELCOME", p.welcomeHandler, 0)
+	server.RegisterEvent("in", "RPL_ISUPPORT", p.featuresHandler, 0)
+	server.RegisterEvent("in", "PING", p.pingHandler, 0)
+	server.RegisterEvent("in", "ERR_NICKNAMEINUSE", p.nicknameInUseHandler, 0)
+	server.RegisterEvent("out", "server disconnected", func(string, eventmgr.InfoMap) {
+		close(p.disconnected)
+	}, 0)
+	return p
+}
+
+// rawHandler queues every inbound line for expect.
+func (p *ircProbe) rawHandler(event string, info eventmgr.InfoMap) {
+	msg, err := ircmsg.ParseLine(info["data"].(string))
+	if err != nil {
+		return
+	}
+	// expect may get to these late, so note when they arrived here
+	if isCommand("NOTICE")(msg) && len(msg.Params) > 1 && (msg.Params[0] == "*" || strings.EqualFold(msg.Params[0], "AUTH")) {
+		p.mu.Lock()
+		p.authNotices = append(p.authNotices, authNotice{text: msg.Params[len(msg.Params)-1], received: time.Now()})
+		p.mu.Unlock()
+	}
+	// and these could come while expect is waiting for something else
+	if isCommand(serverErrorCommands...)(msg) && len(msg.Params) > 0 {
+		p.mu.Lock()
+		p.serverErrors = append(p.serverErrors, msg)
+		p.mu.Unlock()
+	}
+	// capLS reads these without taking the lines register waits for out of
+	// the queue
+	p.recordCapLS(msg)
+	select {
+	case p.messages <- msg:
+	case <-p.done:
+	}
+}
+
+// capHandler requests the caps we want from those the server lists, then
+// ends negotiation so that the NICK and USER sent on connecting complete
+// registration.
+func (p *ircProbe) capHandler(event string, info eventmgr.InfoMap) {
+	params := info["params"].([]string)
+	if len(params) < 3 {
+		return
+	}
+	switch strings.ToUpper(params[1]) {
+	case "LS":
+		// "CAP * LS * :caps" means more lines are to come
+		if len(params) > 3 {
+			p.server.Caps.AddCaps(strings.Split(params[3], " ")...)
+			return
+		}
+		p.server.Caps.AddCaps(strings.Split(params[2], " ")...)
+		if caps := p.server.Caps.ToRequestLine(); caps != "" {
+			p.server.Send(nil, "", "CAP", "REQ", caps)
+		}
+		if !p.server.Registered {
+			p.server.Send(nil, "", "CAP", "END")
+		}
+	case "ACK":
+		p.server.Caps.EnableCaps(strings.Split(params[2], " ")...)
+	case "DEL":
+		p.server.Caps.DelCaps(strings.Split(params[2], " ")...)
+	}
+}
+
+func (p *ircProbe) welcomeHandler(event string, info eventmgr.InfoMap) {
+	if params := info["params"].([]string); len(params) > 0 {
+		p.server.Nick = params[0]
+	}
+	p.server.Registered = true
+}
+
+func (p *ircProbe) featuresHandler(event string, info eventmgr.InfoMap) {
+	// the first and last params are our nick and "are supported"
+	if params := info["params"].([]string); len(params) > 2 {
+		p.server.Features.Parse(params[1 : len(params)-1]...)
+	}
+}
+
+func (p *ircProbe) pingHandler(event string, info eventmgr.InfoMap) {
+	p.send("PONG", info["params"].([]string)...)
+}
+
+// nicknameInUseHandler picks another nick if ours is taken while we
+// register.
+func (p *ircProbe) nicknameInUseHandler(event string, info eventmgr.InfoMap) {
+	if p.server.Registered {
+		return
+	}
+	p.server.Nick += "_"
+	p.send("NICK", p.server.Nick)
+}
+
+// close disconnects from the server and stops queueing inbound lines so the
+// receive loop can't block on a probe that has finished.
+func (p *ircProbe) close() {
+	if p.connected {
+		p.server.Shutdown("probe done")
+	}
+	if p.ident != nil {
+		identServer.remove(*p.ident)
+	}
+	close(p.done)
+}
+
+func (p *ircProbe) send(command string, params ...string) error {
+	// gircclient's Send writes the line out as a format string, which would
+	// mangle passwords and the like with a % in them
+	escaped := make([]string, len(params))
+	for i, param := range params {
+		escaped[i] = strings.Replace(param, "%", "%%", -1)
+	}
+	return p.server.Send(nil, "", command, escaped...)
+}
+
+// expect discards inbound messages until one satisfies match, giving up once
+// timeout or the probe's overall deadline passes.
+func (p *ircProbe) expect(timeout time.Duration, match func(ircmsg.IrcMessage) bool) (ircmsg.IrcMessage, error) {
+	if remaining := time.Until(p.deadline); remaining < timeout {
+		timeout = remaining
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case msg := <-p.messages:
+			if match(msg) {
+				return msg, nil
+			}
+		case <-p.disconnected:
+			// drain whatever arrived before the connection closed
+			for {
+				select {
+				case msg := <-p.messages:
+					if match(msg) {
+						return msg, nil
+					}
+				default:
+					return ircmsg.IrcMessage{}, errDisconnected
+				}
+			}
+		case <-timer.C:
+			return ircmsg.IrcMessage{}, errTimeout
+		}
+	}
+}
+
+// expectExtending is expect with a budget of its own: the probe's deadline
+// doesn't cut timeout short, and is pushed back by however long the wait
+// takes, so later checks keep the time they had left.
+func (p *ircProbe) expectExtending(timeout time.Duration, match func(ircmsg.IrcMessage) bool) (ircmsg.IrcMessage, error) {
+	start := time.Now()
+	deadline := p.deadline
+	p.deadline = start.Add(timeout)
+	msg, err := p.expect(timeout, match)
+	p.deadline = deadline.Add(time.Since(start))
+	return msg, err
+}
+
+// expectReply waits for a message matching ok. A message matching fail ends
+// the wait early, with an error describing what the server said.
+func (p *ircProbe) expectReply(ok, fail func(ircmsg.IrcMessage) bool) (ircmsg.IrcMessage, error) {
+	msg, err := p.expect(p.module.Timeout, func(msg ircmsg.IrcMessage) bool {
+		return ok(msg) || fail(msg)
+	})
+	if err != nil {
+		return msg, err
+	}
+	if !ok(msg) {
+		return msg, fmt.Errorf("server replied %s %s", msg.Command, strings.Join(msg.Params, " "))
+	}
+	return msg, nil
+}
+
+// recordCapLS notes the caps listed in a CAP LS reply, and ends the wait for
+// it on the reply's last line, a numeric error answering CAP from a server
+// that doesn't support it, or RPL_WELCOME from one that registered us
+// without it.
+func (p *ircProbe) recordCapLS(msg ircmsg.IrcMessage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.capLSEnded {
+		return
+	}
+	switch {
+	case isCommand("CAP")(msg) && len(msg.Params) > 2 && strings.EqualFold(msg.Params[1], "LS"):
+		for _, token := range strings.Fields(msg.Params[len(msg.Params)-1]) {
+			parts := strings.SplitN(token, "=", 2)
+			if len(parts) == 2 {
+				p.listedCaps[parts[0]] = parts[1]
+			} else {
+				p.listedCaps[parts[0]] = ""
+			}
+		}
+		// every line but the last of a multiline reply has a "*" before
+		// the list
+		if len(msg.Params) > 3 && msg.Params[2] == "*" {
+			return
+		}
+	case isCommand("001")(msg):
+	case len(msg.Command) == 3 && msg.Command[0] == '4' && len(msg.Params) > 1 && strings.EqualFold(msg.Params[1], "CAP"):
+	default:
+		return
+	}
+	p.capLSEnded = true
+	close(p.capLSDone)
+}
+
+// capLS waits for the server's reply to the CAP LS we sent on connecting, and
+// returns the capabilities it lists with their values, or none if it doesn't
+// support CAP. The reply is recorded by the receive loop rather than read
+// from server.Caps, which gircclient is still filling in from its own
+// goroutine, and stays in the queue for register.
+func (p *ircProbe) capLS() (map[string]string, error) {
+	timer := time.NewTimer(time.Until(p.deadline))
+	defer timer.Stop()
+	select {
+	case <-p.capLSDone:
+	case <-p.disconnected:
+		// the reply may have come just before the connection closed
+		select {
+		case <-p.capLSDone:
+		default:
+			return nil, errDisconnected
+		}
+	case <-timer.C:
+		return nil, errTimeout
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	caps := make(map[string]string, len(p.listedCaps))
+	for name, value := range p.listedCaps {
+		caps[name] = value
+	}
+	return caps, nil
+}
+
+// register waits for RPL_WELCOME. gircclient's own handlers take care of CAP
+// negotiation and sending NICK/USER once the connection is up.
+//
+// It then waits for the end of the MOTD: by that point the server has sent
+// its ISUPPORT tokens, so server.Features is safe to read from the probe.
+func (p *ircProbe) register() error {
+	msg, err := p.expect(p.module.Timeout, func(msg ircmsg.IrcMessage) bool {
+		return isCommand("001")(msg) || isRefusal(msg)
+	})
+	if err != nil {
+		return err
+	}
+	if isRefusal(msg) {
+		return refusedError{msg}
+	}
+	if len(msg.Params) > 0 {
+		p.nick = msg.Params[0]
+		// not every server ends RPL_WELCOME with our nick!user@host
+		if fields := strings.Fields(msg.Params[len(msg.Params)-1]); len(fields) > 0 {
+			if uh := ircutils.ParseUserhost(fields[len(fields)-1]); uh.Host != "" {
+				p.host = uh.Host
+				p.user = uh.User
+			}
+		}
+	}
+	_, err = p.expect(p.module.Timeout, func(msg ircmsg.IrcMessage) bool {
+		if isCommand("372")(msg) && len(msg.Params) > 1 {
+			p.motd = append(p.motd, msg.Params[len(msg.Params)-1])
+		}
+		if isCommand("396")(msg) && len(msg.Params) > 2 {
+			p.host = msg.Params[1]
+		}
+		return isCommand("376", "422")(msg)
+	})
+	return err
+}
+
+// refusedError is returned by register when the server explicitly refuses
+// to register us.
+type refusedError struct {
+	msg ircmsg.IrcMessage
+}
+
+func (e refusedError) Error() string {
+	return fmt.Sprintf("server refused registration: %s %s", e.msg.Command, strings.Join(e.msg.Params, " "))
+}
+
+// isRefusal matches ERROR, FAIL and the 4xx numerics a server ends
+// registration with, but not those that leave it waiting for us to try
+// again, like ERR_NICKNAMEINUSE, or that answer CAP on servers without it.
+func isRefusal(msg ircmsg.IrcMessage) bool {
+	if isCommand("ERROR", "FAIL")(msg) {
+		return true
+	}
+	if isCommand("410", "421", "432", "433", "436", "437")(msg) {
+		return false
+	}
+	numeric, err := strconv.Atoi(msg.Command)
+	return err == nil && len(msg.Command) == 3 && numeric >= 400 && numeric < 500
+}
+
+// checkHost exports, as the named gauge, whether the server reported
+// expected as our host.
+func (p *ircProbe) checkHost(name, help, expected string) {
+	match := prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+	p.registry.MustRegister(match)
+	if strings.EqualFold(p.host, expected) {
+		match.Set(1)
+	} else {
+		log.Printf("[ERROR] Server reported our host as %q, not %q", p.host, expected)
+	}
+}
+
+// isCommand matches messages with any of the given commands or numerics.
+func isCommand(commands ...string) func(ircmsg.IrcMessage) bool {
+	return func(msg ircmsg.IrcMessage) bool {
+		for _, command := range commands {
+			if strings.EqualFold(msg.Command, command) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// isNoticeFrom matches NOTICEs sent by nick whose stripped text matches re.
+func isNoticeFrom(nick string, re *regexp.Regexp) func(ircmsg.IrcMessage) bool {
+	return func(msg ircmsg.IrcMessage) bool {
+		if !strings.EqualFold(msg.Command, "NOTICE") || len(msg.Params) < 2 {
+			return false
+		}
+		if !strings.EqualFold(sourceNick(msg), nick) {
+			return false
+		}
+		return re.MatchString(stripFormatting(msg.Params[len(msg.Params)-1]))
+	}
+}
+
+// sourceNick returns the nickname (or server name) a message came from.
+func sourceNick(msg ircmsg.IrcMessage) string {
+	uh := ircutils.ParseUserhost(msg.Prefix)
+	if uh.Nick != "" {
+		return uh.Nick
+	}
+	return msg.Prefix
+}
+
+var formattingRegexp = regexp.MustCompile("\x03([0-9]{1,2}(,[0-9]{1,2})?)?|[\x02\x0f\x11\x16\x1d\x1e\x1f]")
+
+// stripFormatting removes IRC bold, colour and similar control codes.
+func stripFormatting(text string) string {
+	return formattingRegexp.ReplaceAllString(text, "")
+}
+
+// modeChange is a single mode letter set or unset by a MODE message.
+type modeChange struct {
+	add   bool
+	mode  byte
+	param string
+}
+
+// parseChannelModes splits a channel MODE message into individual changes,
+// using the server's CHANMODES and PREFIX tokens to tell which modes take a
+// parameter.
+func parseChannelModes(features gircclient.ServerFeatures, params []string) []modeChange {
+	if len(params) < 2 {
+		return nil
+	}
+
+	// type A and B modes always carry a parameter, type C ones only when set
+	alwaysParam, setParam := "beIk", "l"
+	if chanmodes, ok := features["CHANMODES"].(string); ok {
+		groups := strings.SplitN(chanmodes, ",", 4)
+		if len(groups) >= 3 {
+			alwaysParam, setParam = groups[0]+groups[1], groups[2]
+		}
+	}
+	alwaysParam += prefixModes(features)
+
+	var changes []modeChange
+	args := params[2:]
+	add := true
+	for i := 0; i < len(params[1]); i++ {
+		c := params[1][i]
+		switch c {
+		case '+':
+			add = true
+			continue
+		case '-':
+			add = false
+			continue
+		}
+		change := modeChange{add: add, mode: c}
+		takesParam := strings.IndexByte(alwaysParam, c) != -1 ||
+			(add && strings.IndexByte(setParam, c) != -1)
+		if takesParam && len(args) > 0 {
+			change.param = args[0]
+			args = args[1:]
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+// prefixModes returns the channel modes from the server's PREFIX token, in
+// order of rank.
+func prefixModes(features gircclient.ServerFeatures) string {
+	modes, _ := splitPrefix(features)
+	return modes
+}
+
+// splitPrefix splits the PREFIX ISUPPORT token, e.g. "(ov)@+", into its mode
+// letters and their matching prefix symbols.
+func splitPrefix(features gircclient.ServerFeatures) (string, string) {
+	prefix, _ := features["PREFIX"].(string)
+	end := strings.IndexByte(prefix, ')')
+	if !strings.HasPrefix(prefix, "(") || end == -1 {
+		return "ov", "@+"
+	}
+	return prefix[1:end], prefix[end+1:]
+}
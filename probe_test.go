@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fakeIRCd accepts one connection and answers registration the way a server
+// with or without CAP would, sending capLines in reply to CAP LS.
+func fakeIRCd(t *testing.T, capLines []string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		welcome := func() {
+			fmt.Fprint(conn, ":srv 001 probe :Welcome probe!promirc@client.example.net\r\n")
+			fmt.Fprint(conn, ":srv 375 probe :- srv message of the day\r\n")
+			fmt.Fprint(conn, ":srv 372 probe :- hello\r\n")
+			fmt.Fprint(conn, ":srv 376 probe :End of /MOTD command.\r\n")
+		}
+		scanner := bufio.NewScanner(conn)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			switch {
+			case len(fields) > 1 && fields[0] == "CAP" && fields[1] == "LS":
+				if capLines == nil {
+					fmt.Fprint(conn, ":srv 421 * CAP :Unknown command\r\n")
+				}
+				for _, line := range capLines {
+					fmt.Fprintf(conn, ":srv CAP * LS %s\r\n", line)
+				}
+			case len(fields) > 1 && fields[0] == "CAP" && fields[1] == "END":
+				welcome()
+			case len(fields) > 0 && fields[0] == "USER" && capLines == nil:
+				welcome()
+			}
+		}
+	}()
+	return l
+}
+
+func TestCapLS(t *testing.T) {
+	tests := []struct {
+		name     string
+		capLines []string
+		want     map[string]string
+	}{
+		{
+			name:     "single line",
+			capLines: []string{":multi-prefix sts=port=6697,duration=300"},
+			want:     map[string]string{"multi-prefix": "", "sts": "port=6697,duration=300"},
+		},
+		{
+			name:     "multiline",
+			capLines: []string{"* :multi-prefix", ":sts=port=6697"},
+			want:     map[string]string{"multi-prefix": "", "sts": "port=6697"},
+		},
+		{
+			name: "no CAP support",
+			want: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l := fakeIRCd(t, test.capLines)
+			defer l.Close()
+			module := defaultModule
+			module.Timeout = 2 * time.Second
+			tgt := &url.URL{Scheme: "irc", Host: l.Addr().String()}
+			p, err := connect(tgt, tgt.Host, module, prometheus.NewRegistry())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.close()
+
+			caps, err := p.capLS()
+			if err != nil {
+				t.Fatalf("capLS() = %v", err)
+			}
+			if !reflect.DeepEqual(caps, test.want) {
+				t.Errorf("capLS() = %v, want %v", caps, test.want)
+			}
+			// waiting for CAP LS must leave registration for register
+			if err := p.register(); err != nil {
+				t.Fatalf("register() after capLS() = %v", err)
+			}
+			if p.nick != "probe" || !reflect.DeepEqual(p.motd, []string{"- hello"}) {
+				t.Errorf("registered as %q with MOTD %q, want probe with the MOTD", p.nick, p.motd)
+			}
+		})
+	}
+}
+
+func TestIsRefusal(t *testing.T) {
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"ERROR :Closing Link: 127.0.0.1 (K-Lined)", true},
+		{":irc.example.net 465 * :You are banned from this server", true},
+		{":irc.example.net 463 * :Your host isn't among the privileged", true},
+		{"FAIL * ACCOUNT_REQUIRED :You must log in to connect", true},
+		// these leave the server waiting for another NICK, or answer CAP
+		{":irc.example.net 433 * promirc_1 :Nickname is already in use", false},
+		{":irc.example.net 432 * promirc_1 :Erroneous nickname", false},
+		{":irc.example.net 421 * CAP :Unknown command", false},
+		{":irc.example.net 410 * FOO :Invalid CAP command", false},
+		{":irc.example.net 001 promirc_1 :Welcome to the network", false},
+		{":irc.example.net NOTICE * :*** Looking up your hostname...", false},
+	}
+	for _, test := range tests {
+		msg, err := ircmsg.ParseLine(test.line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isRefusal(msg); got != test.want {
+			t.Errorf("isRefusal(%q) = %v, want %v", test.line, got, test.want)
+		}
+	}
+}
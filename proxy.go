@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// proxyConn is a connection tunnelled through the module's proxy.
+type proxyConn struct {
+	net.Conn
+	// reader holds anything the server sent that arrived along with the
+	// proxy's reply.
+	reader io.Reader
+	// connectDuration is how long it took to connect to the proxy and have
+	// it connect to the target.
+	connectDuration time.Duration
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// proxiedConn returns the proxy connection conn runs over, if any.
+func proxiedConn(conn net.Conn) (*proxyConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *proxyConn:
+			return c, true
+		case *wsConn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
+
+// dialProxy connects to address through the proxy at proxyURL.
+func dialProxy(proxyURL *url.URL, address string, module Module) (*proxyConn, error) {
+	start := time.Now()
+	dialer := &net.Dialer{Timeout: module.Timeout}
+	if module.SourceIPAddress != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(module.SourceIPAddress)}
+	}
+	proxyAddress := proxyURL.Host
+	if proxyURL.Port() == "" {
+		port := "1080"
+		if proxyURL.Scheme == "http" {
+			port = "8080"
+		}
+		proxyAddress = net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+	conn, err := dialer.Dial("tcp", proxyAddress)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to proxy: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(module.Timeout))
+
+	var reader io.Reader = conn
+	switch proxyURL.Scheme {
+	case "http":
+		reader, err = httpConnect(conn, proxyURL, address)
+	case "socks5":
+		// resolve the target ourselves, as the module asks
+		address, err = resolveProxied(address, module)
+		if err == nil {
+			err = socks5Connect(conn, proxyURL, address)
+		}
+	case "socks5h":
+		err = socks5Connect(conn, proxyURL, address)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return &proxyConn{Conn: conn, reader: reader, connectDuration: time.Since(start)}, nil
+}
+
+// resolveProxied resolves the host of address to an address of the
+// module's preferred IP protocol.
+func resolveProxied(address string, module Module) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) != nil {
+		return address, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), module.Timeout)
+	defer cancel()
+	addrs, err := resolver(module).LookupIPAddr(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		if preferred := module.PreferredIPProtocol; (preferred == "ip4" || preferred == "ip6") && preferred != ipFamily(addr.IP) {
+			continue
+		}
+		return net.JoinHostPort(addr.IP.String(), port), nil
+	}
+	return "", fmt.Errorf("%s has no %s address", host, module.PreferredIPProtocol)
+}
+
+// httpConnect asks an HTTP proxy to tunnel conn to address with CONNECT.
+// It returns the reader to read the tunnel through, which may hold data the
+// target sent straight after the proxy's reply.
+func httpConnect(conn net.Conn, proxyURL *url.URL, address string) (io.Reader, error) {
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused CONNECT: %s", resp.Status)
+	}
+	return reader, nil
+}
+
+// socks5Connect asks a SOCKS5 proxy (RFC 1928) to connect conn to address,
+// authenticating with the proxy URL's username and password if it has them.
+func socks5Connect(conn net.Conn, proxyURL *url.URL, address string) error {
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q", portString)
+	}
+
+	method := byte(0x00)
+	if proxyURL.User != nil {
+		method = 0x02
+	}
+	if _, err := conn.Write([]byte{0x05, 0x01, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 || reply[1] != method {
+		return errors.New("socks proxy refused our authentication method")
+	}
+	if method == 0x02 {
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("socks username and password must be at most 255 bytes")
+		}
+		auth := append([]byte{0x01, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return errors.New("socks proxy rejected our username and password")
+		}
+	}
+
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("hostname %q is too long for socks", host)
+		}
+		req = append(append(req, 0x03, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 0x01), ip4...)
+	} else {
+		req = append(append(req, 0x04), ip.To16()...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("socks proxy could not connect: %s", socks5Error(header[1]))
+	}
+	// skip the address the proxy bound, which we've no use for
+	var boundLength int
+	switch header[3] {
+	case 0x01:
+		boundLength = net.IPv4len
+	case 0x04:
+		boundLength = net.IPv6len
+	case 0x03:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		boundLength = int(length[0])
+	default:
+		return errors.New("socks proxy replied with an unknown address type")
+	}
+	_, err = io.ReadFull(conn, make([]byte, boundLength+2))
+	return err
+}
+
+var socks5Errors = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func socks5Error(code byte) string {
+	if msg, ok := socks5Errors[code]; ok {
+		return msg
+	}
+	return fmt.Sprintf("error %d", code)
+}
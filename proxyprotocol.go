@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// proxyProtocolV2Signature starts every PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// writeProxyHeader sends a PROXY protocol header on conn claiming the
+// connection comes from the module's spoofed source address.
+func writeProxyHeader(conn net.Conn, address string, module Module) error {
+	cfg := module.ProxyProtocol
+	// validate has already checked the source address
+	srcIP, srcPort, _ := cfg.source()
+
+	// the destination is wherever we connected, which through a proxy we
+	// may only know by name
+	var dstIP net.IP
+	var dstPort int
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		dstIP = net.ParseIP(host)
+		dstPort, _ = strconv.Atoi(port)
+	}
+	if _, proxied := conn.(*proxyConn); !proxied {
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+			dstIP, dstPort = addr.IP, addr.Port
+		}
+	}
+	v4 := srcIP.To4() != nil
+	if dstIP == nil || (dstIP.To4() != nil) != v4 {
+		if v4 {
+			dstIP = net.IPv4zero
+		} else {
+			dstIP = net.IPv6unspecified
+		}
+	}
+
+	var header []byte
+	if cfg.Version == 1 {
+		family := "TCP6"
+		if v4 {
+			family = "TCP4"
+		}
+		header = []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", family, srcIP, dstIP, srcPort, dstPort))
+	} else {
+		var buf bytes.Buffer
+		buf.Write(proxyProtocolV2Signature)
+		// version 2, PROXY command
+		buf.WriteByte(0x21)
+		if v4 {
+			// TCP over IPv4, and the length of the addresses
+			buf.Write([]byte{0x11, 0x00, 12})
+			buf.Write(srcIP.To4())
+			buf.Write(dstIP.To4())
+		} else {
+			buf.Write([]byte{0x21, 0x00, 36})
+			buf.Write(srcIP.To16())
+			buf.Write(dstIP.To16())
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(srcPort))
+		binary.Write(&buf, binary.BigEndian, uint16(dstPort))
+		header = buf.Bytes()
+	}
+	_, err := conn.Write(header)
+	return err
+}
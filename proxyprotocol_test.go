@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// proxyHeader returns what writeProxyHeader sends over conn, read from its
+// peer.
+func proxyHeader(t *testing.T, conn, peer net.Conn, address string, cfg ProxyProtocolConfig) []byte {
+	module := defaultModule
+	module.ProxyProtocol = cfg
+	errs := make(chan error, 1)
+	go func() {
+		errs <- writeProxyHeader(conn, address, module)
+		conn.Close()
+	}()
+	header, err := ioutil.ReadAll(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("writeProxyHeader() = %v", err)
+	}
+	return header
+}
+
+func TestWriteProxyHeader(t *testing.T) {
+	v2 := func(family byte, length byte, addresses ...[]byte) []byte {
+		header := append(append([]byte(nil), proxyProtocolV2Signature...), 0x21, family, 0x00, length)
+		for _, address := range addresses {
+			header = append(header, address...)
+		}
+		return header
+	}
+	tests := []struct {
+		name    string
+		cfg     ProxyProtocolConfig
+		address string
+		want    []byte
+	}{
+		{
+			name:    "v1 IPv4",
+			cfg:     ProxyProtocolConfig{Version: 1, SourceAddress: "203.0.113.7:4000"},
+			address: "192.0.2.1:6667",
+			want:    []byte("PROXY TCP4 203.0.113.7 192.0.2.1 4000 6667\r\n"),
+		},
+		{
+			name:    "v1 IPv6",
+			cfg:     ProxyProtocolConfig{Version: 1, SourceAddress: "[2001:db8::7]:4000"},
+			address: "[2001:db8::1]:6697",
+			want:    []byte("PROXY TCP6 2001:db8::7 2001:db8::1 4000 6697\r\n"),
+		},
+		{
+			name:    "v1 source without a port",
+			cfg:     ProxyProtocolConfig{Version: 1, SourceAddress: "203.0.113.7"},
+			address: "192.0.2.1:6667",
+			want:    []byte("PROXY TCP4 203.0.113.7 192.0.2.1 0 6667\r\n"),
+		},
+		{
+			name:    "v1 destination only known by name",
+			cfg:     ProxyProtocolConfig{Version: 1, SourceAddress: "203.0.113.7:4000"},
+			address: "irc.example.net:6667",
+			want:    []byte("PROXY TCP4 203.0.113.7 0.0.0.0 4000 6667\r\n"),
+		},
+		{
+			name:    "v1 destination of the other family",
+			cfg:     ProxyProtocolConfig{Version: 1, SourceAddress: "[2001:db8::7]:4000"},
+			address: "192.0.2.1:6667",
+			want:    []byte("PROXY TCP6 2001:db8::7 :: 4000 6667\r\n"),
+		},
+		{
+			name:    "v2 IPv4",
+			cfg:     ProxyProtocolConfig{Version: 2, SourceAddress: "203.0.113.7:4000"},
+			address: "192.0.2.1:6667",
+			want:    v2(0x11, 12, []byte{203, 0, 113, 7}, []byte{192, 0, 2, 1}, []byte{0x0f, 0xa0, 0x1a, 0x0b}),
+		},
+		{
+			name:    "v2 IPv6",
+			cfg:     ProxyProtocolConfig{Version: 2, SourceAddress: "[2001:db8::7]:4000"},
+			address: "[2001:db8::1]:6697",
+			want:    v2(0x21, 36, net.ParseIP("2001:db8::7"), net.ParseIP("2001:db8::1"), []byte{0x0f, 0xa0, 0x1a, 0x29}),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, peer := net.Pipe()
+			defer peer.Close()
+			if got := proxyHeader(t, conn, peer, test.address, test.cfg); !bytes.Equal(got, test.want) {
+				t.Errorf("header = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// TestWriteProxyHeaderUsesPeerAddress checks that the header names the
+// address actually connected to, rather than the target's hostname.
+func TestWriteProxyHeaderUsesPeerAddress(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	got := proxyHeader(t, conn, peer, "irc.example.net:6667", ProxyProtocolConfig{Version: 1, SourceAddress: "203.0.113.7:4000"})
+	if want := fmt.Sprintf("PROXY TCP4 203.0.113.7 127.0.0.1 4000 %d\r\n", port); string(got) != want {
+		t.Errorf("header = %q, want %q", got, want)
+	}
+}
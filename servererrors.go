@@ -0,0 +1,56 @@
+package main
+
+import (
+	"log"
+	"regexp"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serverErrorCommands are ERROR and the numerics servers refuse
+// connections with: ERR_NOPERMFORHOST, ERR_YOUREBANNEDCREEP and
+// ERR_RESTRICTED.
+var serverErrorCommands = []string{"ERROR", "463", "465", "484"}
+
+// numericReasons are the reasons for numerics whose text none of the
+// module's error_reasons match.
+var numericReasons = map[string]string{
+	"463": "banned",
+	"465": "banned",
+	"484": "restricted",
+}
+
+// probeServerErrors logs the ERROR lines and ban numerics the server sent
+// and exports them by reason, so that the exporter being throttled or
+// banned can be told apart from an outage.
+func probeServerErrors(p *ircProbe) {
+	serverError := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_server_error_info",
+		Help: "error or ban numeric the server sent, by reason",
+	}, []string{"command", "reason"})
+	p.registry.MustRegister(serverError)
+
+	p.mu.Lock()
+	msgs := append([]ircmsg.IrcMessage(nil), p.serverErrors...)
+	p.mu.Unlock()
+
+	for _, msg := range msgs {
+		text := msg.Params[len(msg.Params)-1]
+		log.Printf("[ERROR] Server sent %s: %s", msg.Command, text)
+		serverError.WithLabelValues(msg.Command, errorReason(p.module.ErrorReasons, msg.Command, text)).Set(1)
+	}
+}
+
+// errorReason classifies the text the server sent with command.
+func errorReason(reasons []ErrorReason, command, text string) string {
+	for _, reason := range reasons {
+		if regexp.MustCompile(reason.Regexp).MatchString(text) {
+			return reason.Reason
+		}
+	}
+	if reason, ok := numericReasons[command]; ok {
+		return reason
+	}
+	return "unknown"
+}
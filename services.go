@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const accountRegistrationCap = "draft/account-registration"
+
+var servicesSteps = []string{
+	"nick_register",
+	"login",
+	"channel_register",
+	"channel_op",
+	"channel_drop",
+	"nick_drop",
+}
+
+// servicesLifecycle holds the state of a single services lifecycle check.
+type servicesLifecycle struct {
+	p        *ircProbe
+	cfg      ServicesConfig
+	channel  string
+	replacer *strings.Replacer
+	loggedIn bool
+}
+
+// probeServices registers a throwaway account and channel with services,
+// checks that we get logged in and opped, then drops both again.
+func probeServices(p *ircProbe, cfg ServicesConfig) {
+	success := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_services_step_success",
+		Help: "services lifecycle step succeeded",
+	}, []string{"step"})
+	duration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_services_step_duration_seconds",
+		Help: "time taken by a services lifecycle step",
+	}, []string{"step"})
+	p.registry.MustRegister(success, duration)
+	for _, step := range servicesSteps {
+		success.WithLabelValues(step).Set(0)
+	}
+
+	s := &servicesLifecycle{
+		p:       p,
+		cfg:     cfg,
+		channel: fmt.Sprintf("%s%d", cfg.ChannelPrefix, rand.Int31()),
+	}
+	s.replacer = strings.NewReplacer(
+		"{nick}", p.nick,
+		"{account}", p.nick,
+		"{password}", fmt.Sprintf("%x", rand.Int63()),
+		"{email}", cfg.Email,
+		"{channel}", s.channel,
+	)
+
+	run := func(step string, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		duration.WithLabelValues(step).Set(time.Since(start).Seconds())
+		if err != nil {
+			log.Printf("[ERROR] Services step %s failed: %v", step, err)
+			return false
+		}
+		success.WithLabelValues(step).Set(1)
+		return true
+	}
+
+	// drops run even when a later step fails so we don't leave registrations
+	// behind on the network
+	if !run("nick_register", s.registerNick) {
+		return
+	}
+	if run("login", s.login) && run("channel_register", s.registerChannel) {
+		run("channel_op", s.op)
+		run("channel_drop", s.dropChannel)
+	}
+	run("nick_drop", s.dropNick)
+}
+
+func (s *servicesLifecycle) command(template string) string {
+	return s.replacer.Replace(template)
+}
+
+func (s *servicesLifecycle) registerNick() error {
+	if s.cfg.UseAccountRegistration && s.p.server.Caps.Enabled[accountRegistrationCap] {
+		return s.registerAccount()
+	}
+
+	s.p.send("PRIVMSG", s.cfg.NickServ, s.command(s.cfg.NickRegisterCommand))
+	return s.expectRegistered(s.cfg.NickServ, s.cfg.NickRegisteredRegexp, s.cfg.NickRegisterFailedRegexp)
+}
+
+// expectRegistered waits for service to confirm a registration with a
+// notice matching registeredRegexp, or to refuse it with one matching
+// failedRegexp.
+func (s *servicesLifecycle) expectRegistered(service, registeredRegexp, failedRegexp string) error {
+	isRegistered := isNoticeFrom(service, regexp.MustCompile(registeredRegexp))
+	isFailed := isNoticeFrom(service, regexp.MustCompile(failedRegexp))
+	msg, err := s.p.expect(s.p.module.Timeout, func(msg ircmsg.IrcMessage) bool {
+		// services may log us in before confirming the registration
+		if isCommand("900")(msg) {
+			s.loggedIn = true
+		}
+		return isFailed(msg) || isRegistered(msg)
+	})
+	if err != nil {
+		return err
+	}
+	if isFailed(msg) {
+		return fmt.Errorf("%s refused: %s", service, stripFormatting(msg.Params[len(msg.Params)-1]))
+	}
+	return nil
+}
+
+// registerAccount registers through the draft/account-registration cap
+// rather than by messaging NickServ.
+func (s *servicesLifecycle) registerAccount() error {
+	email := s.cfg.Email
+	if email == "" {
+		email = "*"
+	}
+	s.p.send("REGISTER", "*", email, s.command("{password}"))
+
+	msg, err := s.p.expect(s.p.module.Timeout, func(msg ircmsg.IrcMessage) bool {
+		if isCommand("900")(msg) {
+			s.loggedIn = true
+		}
+		if isCommand("FAIL")(msg) {
+			return len(msg.Params) > 0 && strings.EqualFold(msg.Params[0], "REGISTER")
+		}
+		return isCommand("REGISTER")(msg)
+	})
+	if err != nil {
+		return err
+	}
+	if isCommand("FAIL")(msg) || len(msg.Params) == 0 || msg.Params[0] != "SUCCESS" {
+		return fmt.Errorf("account registration failed: %s", strings.Join(msg.Params, " "))
+	}
+	return nil
+}
+
+// login waits for RPL_LOGGEDIN, identifying to NickServ if services didn't
+// log us in as part of registering.
+func (s *servicesLifecycle) login() error {
+	if s.loggedIn {
+		return nil
+	}
+	return identify(s.p, s.cfg.NickServ, s.command(s.cfg.LoginCommand))
+}
+
+// identify sends command to NickServ and waits for RPL_LOGGEDIN.
+func identify(p *ircProbe, nickserv, command string) error {
+	p.send("PRIVMSG", nickserv, command)
+	_, err := p.expectReply(isCommand("900"), isCommand("902", "904", "905"))
+	return err
+}
+
+func (s *servicesLifecycle) registerChannel() error {
+	s.p.send("JOIN", s.channel)
+	_, err := s.p.expectReply(
+		func(msg ircmsg.IrcMessage) bool {
+			return isCommand("JOIN")(msg) && len(msg.Params) > 0 &&
+				strings.EqualFold(msg.Params[0], s.channel) &&
+				strings.EqualFold(sourceNick(msg), s.p.nick)
+		},
+		isCommand("403", "405", "471", "473", "474", "475", "477", "479"),
+	)
+	if err != nil {
+		return err
+	}
+
+	s.p.send("PRIVMSG", s.cfg.ChanServ, s.command(s.cfg.ChannelRegisterCommand))
+	return s.expectRegistered(s.cfg.ChanServ, s.cfg.ChannelRegisteredRegexp, s.cfg.ChannelRegisterFailedRegexp)
+}
+
+// op deops us in the new channel and checks that ChanServ ops us again.
+func (s *servicesLifecycle) op() error {
+	s.p.send("MODE", s.channel, "-o", s.p.nick)
+	if _, err := s.p.expectReply(s.isOpChange(false), isCommand("482")); err != nil {
+		return fmt.Errorf("could not deop ourselves: %v", err)
+	}
+
+	s.p.send("PRIVMSG", s.cfg.ChanServ, s.command(s.cfg.ChannelOpCommand))
+	_, err := s.p.expect(s.p.module.Timeout, s.isOpChange(true))
+	return err
+}
+
+// isOpChange matches a MODE in our channel that ops or deops us.
+func (s *servicesLifecycle) isOpChange(add bool) func(ircmsg.IrcMessage) bool {
+	return func(msg ircmsg.IrcMessage) bool {
+		if !isCommand("MODE")(msg) || len(msg.Params) < 2 || !strings.EqualFold(msg.Params[0], s.channel) {
+			return false
+		}
+		for _, change := range parseChannelModes(s.p.server.Features, msg.Params) {
+			if change.add == add && change.mode == 'o' && strings.EqualFold(change.param, s.p.nick) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (s *servicesLifecycle) dropChannel() error {
+	err := s.drop(s.cfg.ChanServ, s.cfg.ChannelDropCommand, s.cfg.ChannelDroppedRegexp)
+	s.p.send("PART", s.channel)
+	return err
+}
+
+func (s *servicesLifecycle) dropNick() error {
+	return s.drop(s.cfg.NickServ, s.cfg.NickDropCommand, s.cfg.NickDroppedRegexp)
+}
+
+// drop sends a DROP-style command to service and waits for the notice
+// confirming it, first answering a confirmation prompt if services send one.
+func (s *servicesLifecycle) drop(service, template, droppedRegexp string) error {
+	dropped := regexp.MustCompile(droppedRegexp)
+	confirm := regexp.MustCompile(s.cfg.DropConfirmRegexp)
+	isDropped := isNoticeFrom(service, dropped)
+	isConfirm := isNoticeFrom(service, confirm)
+
+	s.p.send("PRIVMSG", service, s.command(template))
+	msg, err := s.p.expect(s.p.module.Timeout, func(msg ircmsg.IrcMessage) bool {
+		return isDropped(msg) || isConfirm(msg)
+	})
+	if err != nil || !isConfirm(msg) {
+		return err
+	}
+
+	match := confirm.FindStringSubmatch(stripFormatting(msg.Params[len(msg.Params)-1]))
+	if len(match) < 2 {
+		return errors.New("drop confirmation prompt had no command to send")
+	}
+	s.p.send("PRIVMSG", service, match[1])
+	_, err = s.p.expect(s.p.module.Timeout, isDropped)
+	return err
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+)
+
+// queuedProbe returns a probe that reads lines from its queue rather than a
+// server.
+func queuedProbe(t *testing.T, lines ...string) *ircProbe {
+	module := defaultModule
+	module.Timeout = 100 * time.Millisecond
+	p := &ircProbe{
+		module:       module,
+		deadline:     time.Now().Add(time.Second),
+		messages:     make(chan ircmsg.IrcMessage, len(lines)),
+		disconnected: make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	for _, line := range lines {
+		msg, err := ircmsg.ParseLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.messages <- msg
+	}
+	return p
+}
+
+func TestExpectRegistered(t *testing.T) {
+	services := defaultModule.Services
+	tests := []struct {
+		name         string
+		service      string
+		lines        []string
+		wantErr      string
+		wantLoggedIn bool
+	}{
+		{
+			name:    "nick registered",
+			service: "NickServ",
+			lines:   []string{":NickServ!services@services.example.net NOTICE promirc_1 :Nickname \x02promirc_1\x02 registered."},
+		},
+		{
+			name:    "nick already registered",
+			service: "NickServ",
+			// this matches the registered regexp too
+			lines:   []string{":NickServ!services@services.example.net NOTICE promirc_1 :Nickname \x02promirc_1\x02 is already registered."},
+			wantErr: "NickServ refused: Nickname promirc_1 is already registered.",
+		},
+		{
+			name:    "invalid email",
+			service: "NickServ",
+			lines:   []string{":NickServ!services@services.example.net NOTICE promirc_1 :Invalid email address."},
+			wantErr: "NickServ refused",
+		},
+		{
+			name:    "email not valid",
+			service: "NickServ",
+			lines:   []string{":NickServ!services@services.example.net NOTICE promirc_1 :\x02foo\x02 is not a valid email address."},
+			wantErr: "NickServ refused",
+		},
+		{
+			name:    "channel already registered",
+			service: "ChanServ",
+			lines:   []string{":ChanServ!services@services.example.net NOTICE promirc_1 :#promirc_1 is already registered to someone."},
+			wantErr: "ChanServ refused",
+		},
+		{
+			name:    "logged in before confirming",
+			service: "NickServ",
+			lines: []string{
+				":irc.example.net 900 promirc_1 promirc_1!promirc@127.0.0.1 promirc_1 :You are now logged in as promirc_1",
+				":NickServ!services@services.example.net NOTICE promirc_1 :promirc_1 is now registered to promirc@example.invalid",
+			},
+			wantLoggedIn: true,
+		},
+		{
+			name:    "notice from someone else",
+			service: "NickServ",
+			lines:   []string{":mallory!m@example.net NOTICE promirc_1 :Nickname promirc_1 registered."},
+			wantErr: errTimeout.Error(),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &servicesLifecycle{p: queuedProbe(t, test.lines...), cfg: services}
+			registered, failed := services.NickRegisteredRegexp, services.NickRegisterFailedRegexp
+			if test.service == "ChanServ" {
+				registered, failed = services.ChannelRegisteredRegexp, services.ChannelRegisterFailedRegexp
+			}
+			err := s.expectRegistered(test.service, registered, failed)
+			if test.wantErr == "" && err != nil {
+				t.Errorf("expectRegistered() = %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+				t.Errorf("expectRegistered() = %v, want an error containing %q", err, test.wantErr)
+			}
+			if s.loggedIn != test.wantLoggedIn {
+				t.Errorf("loggedIn = %v, want %v", s.loggedIn, test.wantLoggedIn)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/goshuirc/irc-go/ircmsg"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// dialStartTLS connects to address in plaintext and upgrades the connection
+// with the legacy STARTTLS command. Whether the server accepted STARTTLS is
+// exported apart from whether the handshake that follows succeeded.
+func dialStartTLS(address string, tlsConfig *tls.Config, module Module, registry *prometheus.Registry) (*tls.Conn, error) {
+	accepted := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_starttls_accepted",
+		Help: "server accepted the starttls command",
+	})
+	handshakeSuccess := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_starttls_handshake_success",
+		Help: "tls handshake after starttls succeeded",
+	})
+	registry.MustRegister(accepted, handshakeSuccess)
+
+	conn, err := dialTCP(address, module)
+	if err != nil {
+		return nil, err
+	}
+	if err := startTLS(conn, module); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	accepted.Set(1)
+
+	tlsConn, err := handshake(conn, tlsConfig, module)
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake after STARTTLS failed: %v", err)
+	}
+	handshakeSuccess.Set(1)
+	return tlsConn, nil
+}
+
+// startTLS sends STARTTLS on a fresh plaintext connection and waits for
+// RPL_STARTTLS, after which the server expects a TLS handshake.
+func startTLS(conn net.Conn, module Module) error {
+	conn.SetDeadline(time.Now().Add(module.Timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(conn, "STARTTLS\r\n"); err != nil {
+		return err
+	}
+	for {
+		line, err := readLine(conn)
+		if err != nil {
+			return fmt.Errorf("waiting for STARTTLS reply: %v", err)
+		}
+		msg, err := ircmsg.ParseLine(line)
+		if err != nil {
+			continue
+		}
+		switch {
+		case isCommand("670")(msg):
+			return nil
+		case isCommand("691", "421", "451", "ERROR")(msg):
+			return fmt.Errorf("server refused STARTTLS: %s %s", msg.Command, strings.Join(msg.Params, " "))
+		}
+	}
+}
+
+// readLine reads a single line from conn a byte at a time, so that nothing
+// after it, i.e. the start of the TLS handshake, is consumed.
+func readLine(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := conn.Read(b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimRight(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// probeSTS checks the IRCv3 strict transport security policy a plaintext
+// target advertises in CAP LS: that its port serves TLS with a valid
+// certificate, and for how long it tells clients to stick to it. It returns
+// whether the target advertised a policy.
+func probeSTS(p *ircProbe, tgt *url.URL, address string) bool {
+	advertised := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_sts_advertised",
+		Help: "target advertised an sts policy",
+	})
+	portValid := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_sts_port_valid",
+		Help: "sts port serves tls with a certificate valid for the target",
+	})
+	duration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_sts_duration_seconds",
+		Help: "how long the sts policy tells clients to only connect with tls",
+	})
+	preload := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_sts_preload",
+		Help: "sts policy allows clients to preload it",
+	})
+	p.registry.MustRegister(advertised, portValid, duration, preload)
+
+	caps, err := p.capLS()
+	if err != nil {
+		log.Printf("[ERROR] Could not read CAP LS: %v", err)
+		return false
+	}
+	value, ok := caps["sts"]
+	if !ok {
+		return false
+	}
+	advertised.Set(1)
+	port := stsKeys(value)["port"]
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		log.Printf("[ERROR] STS policy %q has no valid port", value)
+		return true
+	}
+
+	// clients only take the duration from the policy they see over TLS, so
+	// that's the one to report
+	secure, err := stsSecurePolicy(tgt, address, port, p.module)
+	if err != nil {
+		log.Printf("[ERROR] STS port %s of %s is not valid: %v", port, tgt.Hostname(), err)
+		return true
+	}
+	portValid.Set(1)
+	if seconds, err := strconv.ParseFloat(secure["duration"], 64); err == nil {
+		duration.Set(seconds)
+	}
+	if _, ok := secure["preload"]; ok {
+		preload.Set(1)
+	}
+	return true
+}
+
+// stsSecurePolicy connects to port over TLS, verifying the server's
+// certificate for tgt's host as an STS-aware client would, and returns the
+// keys of the policy it advertises there.
+func stsSecurePolicy(tgt *url.URL, address, port string, module Module) (map[string]string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	secureTgt := *tgt
+	secureTgt.Scheme = "ircs"
+	secureTgt.Host = net.JoinHostPort(tgt.Hostname(), port)
+
+	p, err := connect(&secureTgt, net.JoinHostPort(host, port), module, prometheus.NewRegistry())
+	if err != nil {
+		return nil, err
+	}
+	defer p.close()
+
+	state := p.server.RawConnection.(*tls.Conn).ConnectionState()
+	if len(state.PeerCertificates) == 0 || verifyChain(tgt.Hostname(), state.PeerCertificates, nil) == nil {
+		return nil, fmt.Errorf("certificate is not valid for %s", tgt.Hostname())
+	}
+
+	caps, err := p.capLS()
+	if err != nil {
+		return nil, err
+	}
+	value, ok := caps["sts"]
+	if !ok {
+		return nil, fmt.Errorf("no sts policy advertised over tls")
+	}
+	return stsKeys(value), nil
+}
+
+// stsKeys splits an sts capability value, e.g. "port=6697,duration=300", into
+// its keys. Keys without a value, like "preload", map to "".
+func stsKeys(value string) map[string]string {
+	keys := map[string]string{}
+	for _, token := range strings.Split(value, ",") {
+		parts := strings.SplitN(token, "=", 2)
+		if len(parts) == 2 {
+			keys[parts[0]] = parts[1]
+		} else {
+			keys[parts[0]] = ""
+		}
+	}
+	return keys
+}
+
+// probeSTSPolicy exports whether a plaintext target either advertised an
+// STS policy or explicitly refused to let us register, one of which our
+// policy for public ports requires. Failing to register for any other
+// reason, such as timing out, doesn't count.
+func probeSTSPolicy(registry *prometheus.Registry, advertised, refused bool) {
+	compliant := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_sts_policy_compliant",
+		Help: "plaintext target advertised sts or refused registration",
+	})
+	registry.MustRegister(compliant)
+	if advertised || refused {
+		compliant.Set(1)
+	}
+}
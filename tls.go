@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/ocsp"
+)
+
+// newTLSConfig returns the TLS settings to connect to tgt with.
+func newTLSConfig(tgt *url.URL, module Module) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		// address may be one of the host's IPs, so name the host explicitly
+		ServerName:         tgt.Hostname(),
+		InsecureSkipVerify: true,
+	}
+	if module.TLS.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(module.TLS.CertFile, module.TLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// dialTLS makes a TLS connection to address the same way as for tgt, with
+// STARTTLS for irc+starttls targets.
+func dialTLS(tgt *url.URL, address string, tlsConfig *tls.Config, module Module) (*tls.Conn, error) {
+	conn, err := dialTCP(address, module)
+	if err != nil {
+		return nil, err
+	}
+	if tgt.Scheme == "irc+starttls" {
+		if err := startTLS(conn, module); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return handshake(conn, tlsConfig, module)
+}
+
+// tlsConnectionState returns the TLS state of conn, if it runs over TLS.
+func tlsConnectionState(conn net.Conn) (tls.ConnectionState, bool) {
+	if ws, ok := conn.(*wsConn); ok {
+		conn = ws.Conn
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// probeLeafSPKI exports the SHA-256 of the leaf certificate's public key
+// and, if the module pins any, whether it matches one of them.
+func probeLeafSPKI(state tls.ConnectionState, module Module, registry *prometheus.Registry) {
+	spkiInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_tls_leaf_spki_info",
+		Help: "sha256 of the leaf certificate's subject public key info",
+	}, []string{"sha256"})
+	registry.MustRegister(spkiInfo)
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	sum := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+	spkiInfo.WithLabelValues(hex.EncodeToString(sum[:])).Set(1)
+
+	if len(module.TLS.SPKIPins) == 0 {
+		return
+	}
+	pinMatch := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_tls_pin_match",
+		Help: "leaf certificate's public key matches one of the module's pins",
+	})
+	registry.MustRegister(pinMatch)
+	for _, pin := range module.TLS.SPKIPins {
+		// validate has already checked every pin decodes
+		if decoded, _ := decodePin(pin); bytes.Equal(decoded, sum[:]) {
+			pinMatch.Set(1)
+			break
+		}
+	}
+}
+
+// decodePin decodes a SHA-256 pin given either in hex or, as in HPKP's
+// pin-sha256, in base64.
+func decodePin(pin string) ([]byte, error) {
+	decoded, err := hex.DecodeString(pin)
+	if err != nil {
+		decoded, err = base64.StdEncoding.DecodeString(pin)
+	}
+	if err != nil || len(decoded) != sha256.Size {
+		return nil, errors.New("pin must be a hex or base64 sha256 hash")
+	}
+	return decoded, nil
+}
+
+var ocspStatuses = map[int]string{
+	ocsp.Good:    "good",
+	ocsp.Revoked: "revoked",
+	ocsp.Unknown: "unknown",
+}
+
+// probeOCSP exports the OCSP response the server stapled to the handshake
+// and, if the module asks, the one its responder gives.
+func probeOCSP(state tls.ConnectionState, module Module, registry *prometheus.Registry) {
+	stapled := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_tls_ocsp_stapled",
+		Help: "server stapled an ocsp response to the tls handshake",
+	})
+	status := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_tls_ocsp_status",
+		Help: "ocsp status of the leaf certificate",
+	}, []string{"source", "status"})
+	nextUpdate := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_tls_ocsp_next_update_epoch_seconds",
+		Help: "next update time of the ocsp response in unixtime",
+	}, []string{"source"})
+	registry.MustRegister(stapled, status, nextUpdate)
+
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+	leaf := state.PeerCertificates[0]
+	// without the issuer we can't check the response's signature, but it's
+	// still worth reporting what it says
+	var issuer *x509.Certificate
+	if len(state.PeerCertificates) > 1 {
+		issuer = state.PeerCertificates[1]
+	}
+
+	export := func(source string, resp *ocsp.Response) {
+		for s, name := range ocspStatuses {
+			if s == resp.Status {
+				status.WithLabelValues(source, name).Set(1)
+			} else {
+				status.WithLabelValues(source, name).Set(0)
+			}
+		}
+		if !resp.NextUpdate.IsZero() {
+			nextUpdate.WithLabelValues(source).Set(float64(resp.NextUpdate.Unix()))
+		}
+	}
+
+	if len(state.OCSPResponse) > 0 {
+		stapled.Set(1)
+		resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, leaf, issuer)
+		if err != nil {
+			log.Printf("[ERROR] Could not parse stapled OCSP response: %v", err)
+		} else {
+			export("staple", resp)
+		}
+	}
+
+	if module.TLS.OCSPFetch {
+		resp, err := fetchOCSP(leaf, issuer, module)
+		if err != nil {
+			log.Printf("[ERROR] Could not fetch OCSP response: %v", err)
+			return
+		}
+		export("responder", resp)
+	}
+}
+
+// fetchOCSP asks the leaf's OCSP responder for its status, through the
+// module's OCSP proxy if it has one.
+func fetchOCSP(leaf, issuer *x509.Certificate, module Module) (*ocsp.Response, error) {
+	if issuer == nil {
+		return nil, errors.New("server sent no issuer certificate to build a request from")
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errors.New("certificate names no ocsp responder")
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment}
+	if module.TLS.OCSPProxyURL != "" {
+		// validate has already checked the proxy URL parses
+		proxy, _ := url.Parse(module.TLS.OCSPProxyURL)
+		transport.Proxy = http.ProxyURL(proxy)
+	}
+	client := &http.Client{Transport: transport, Timeout: module.Timeout}
+	httpResp, err := client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder returned %s", httpResp.Status)
+	}
+	body, err := ioutil.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, leaf, issuer)
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+// auditableCipherSuites maps the names of every cipher suite Go can offer
+// on its own to their IDs. TLS 1.3 suites can't be restricted, so they
+// aren't included.
+func auditableCipherSuites() map[string]uint16 {
+	ids := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		for _, version := range suite.SupportedVersions {
+			if version != tls.VersionTLS13 {
+				ids[suite.Name] = suite.ID
+			}
+		}
+	}
+	return ids
+}
+
+// auditTLS makes a handshake offering only each TLS version, then one
+// offering only each audited cipher suite, and exports which the server
+// accepted.
+func auditTLS(tgt *url.URL, address string, module Module, registry *prometheus.Registry) {
+	protocolAccepted := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_tls_protocol_accepted",
+		Help: "server completed a handshake offering only this tls version",
+	}, []string{"version"})
+	cipherAccepted := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_tls_cipher_accepted",
+		Help: "server completed a handshake offering only this cipher suite",
+	}, []string{"suite"})
+	registry.MustRegister(protocolAccepted, cipherAccepted)
+
+	suites := module.TLS.AuditCipherSuites
+	if len(suites) == 0 {
+		for _, suite := range tls.InsecureCipherSuites() {
+			suites = append(suites, suite.Name)
+		}
+	}
+	ids := auditableCipherSuites()
+
+	// the handshakes are independent, so make them all at once to keep
+	// within the module's timeout
+	var wg sync.WaitGroup
+	handshake := func(gauge prometheus.Gauge, restrict func(*tls.Config)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tlsConfig, err := newTLSConfig(tgt, module)
+			if err != nil {
+				return
+			}
+			restrict(tlsConfig)
+			conn, err := dialTLS(tgt, address, tlsConfig, module)
+			if err != nil {
+				gauge.Set(0)
+				return
+			}
+			conn.Close()
+			gauge.Set(1)
+		}()
+	}
+	for version, name := range tlsVersions {
+		version := version
+		handshake(protocolAccepted.WithLabelValues(name), func(c *tls.Config) {
+			c.MinVersion = version
+			c.MaxVersion = version
+		})
+	}
+	for _, name := range suites {
+		id := ids[name]
+		handshake(cipherAccepted.WithLabelValues(name), func(c *tls.Config) {
+			// TLS 1.3 suites can't be restricted, so neither can 1.3 be
+			// offered, and Go won't offer versions before 1.2 unless told
+			// to, which most of the insecure suites need
+			c.MinVersion = tls.VersionTLS10
+			c.MaxVersion = tls.VersionTLS12
+			c.CipherSuites = []uint16{id}
+		})
+	}
+	wg.Wait()
+}
+
+// probeResumption connects twice with a session cache, and exports whether
+// the second connection resumed the first's session and how long each
+// handshake took.
+func probeResumption(tgt *url.URL, address string, module Module, registry *prometheus.Registry) {
+	resumed := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_tls_session_resumed",
+		Help: "second tls connection resumed the first's session",
+	})
+	handshakeDuration := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_tls_handshake_duration_seconds",
+		Help: "time taken by the tls handshake of the session resumption check",
+	}, []string{"connection"})
+	registry.MustRegister(resumed, handshakeDuration)
+
+	tlsConfig, err := newTLSConfig(tgt, module)
+	if err != nil {
+		log.Printf("[ERROR] Could not check TLS session resumption: %v", err)
+		return
+	}
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+
+	for _, connection := range []string{"initial", "resumed"} {
+		conn, err := dialTCP(address, module)
+		if err == nil && tgt.Scheme == "irc+starttls" {
+			if err = startTLS(conn, module); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("[ERROR] Could not check TLS session resumption: %v", err)
+			return
+		}
+		start := time.Now()
+		tlsConn, err := handshake(conn, tlsConfig, module)
+		if err != nil {
+			log.Printf("[ERROR] Could not check TLS session resumption: %v", err)
+			return
+		}
+		handshakeDuration.WithLabelValues(connection).Set(time.Since(start).Seconds())
+
+		if connection == "resumed" {
+			if tlsConn.ConnectionState().DidResume {
+				resumed.Set(1)
+			}
+		} else {
+			awaitSessionTicket(tlsConn, module)
+		}
+		tlsConn.Close()
+	}
+}
+
+// awaitSessionTicket gives a TLS 1.3 server's session ticket, which comes
+// after the handshake, a chance to reach the session cache. Tickets are only
+// processed while reading, so we ask the server for something to read.
+func awaitSessionTicket(conn *tls.Conn, module Module) {
+	if conn.ConnectionState().Version < tls.VersionTLS13 {
+		return
+	}
+	conn.SetDeadline(time.Now().Add(module.Timeout))
+	fmt.Fprintf(conn, "CAP LS 302\r\n")
+	conn.Read(make([]byte, 512))
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// newTestCertificate returns a self-signed ECDSA certificate for host.
+func newTestCertificate(t *testing.T, host string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// gaugeValues returns the value of each of name's gauges in registry, by
+// the value of label, or under "" for a gauge without it.
+func gaugeValues(t *testing.T, registry *prometheus.Registry, name, label string) map[string]float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			key := ""
+			for _, pair := range metric.GetLabel() {
+				if pair.GetName() == label {
+					key = pair.GetValue()
+				}
+			}
+			values[key] = metric.GetGauge().GetValue()
+		}
+	}
+	return values
+}
+
+func TestAuditTLS(t *testing.T) {
+	// a server stuck on TLS 1.0 with a single CBC suite, as the audit is
+	// meant to find
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{newTestCertificate(t, "irc.example.net")},
+		MinVersion:   tls.VersionTLS10,
+		MaxVersion:   tls.VersionTLS10,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	module := defaultModule
+	module.Timeout = 5 * time.Second
+	module.TLS.AuditCipherSuites = []string{
+		"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+		"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	}
+	tgt := &url.URL{Scheme: "ircs", Host: "irc.example.net:6697"}
+	registry := prometheus.NewRegistry()
+	auditTLS(tgt, l.Addr().String(), module, registry)
+
+	for _, check := range []struct {
+		name, label string
+		want        map[string]float64
+	}{
+		{
+			name:  "irc_tls_protocol_accepted",
+			label: "version",
+			want:  map[string]float64{"1.0": 1, "1.1": 0, "1.2": 0, "1.3": 0},
+		},
+		{
+			name:  "irc_tls_cipher_accepted",
+			label: "suite",
+			want: map[string]float64{
+				"TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA": 1,
+				"TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA": 0,
+			},
+		},
+	} {
+		got := gaugeValues(t, registry, check.name, check.label)
+		for value, want := range check.want {
+			if gauge, ok := got[value]; !ok || gauge != want {
+				t.Errorf("%s{%s=%q} = %v, want %v", check.name, check.label, value, gauge, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The IRCv3 WebSocket subprotocols. Each frame carries a single IRC line
+// without its CRLF, as a text frame for text.ircv3.net and a binary one for
+// binary.ircv3.net.
+const (
+	textSubprotocol   = "text.ircv3.net"
+	binarySubprotocol = "binary.ircv3.net"
+)
+
+// WebSocket opcodes from RFC 6455.
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+)
+
+// websocketGUID is appended to the client's key to compute the accept key.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsConn carries IRC lines over a WebSocket, so that gircclient can read and
+// write it like a plain connection.
+type wsConn struct {
+	net.Conn
+	reader *bufio.Reader
+	opcode byte
+
+	// pending holds the rest of the last line read that didn't fit in the
+	// caller's buffer.
+	pending []byte
+
+	writeMu sync.Mutex
+	// partial holds written data not yet ending in a newline.
+	partial []byte
+}
+
+// dialWebSocket connects to a ws:// or wss:// target and upgrades the
+// connection to the WebSocket protocol, exporting how long the upgrade took
+// and the HTTP status the server replied with.
+func dialWebSocket(tgt *url.URL, address string, tlsConfig *tls.Config, module Module, registry *prometheus.Registry) (*wsConn, error) {
+	upgradeDuration := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_websocket_upgrade_duration_seconds",
+		Help: "time taken by the websocket upgrade request",
+	})
+	statusCode := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "irc_websocket_http_status_code",
+		Help: "http status code of the websocket upgrade response",
+	})
+	subprotocolInfo := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "irc_websocket_subprotocol_info",
+		Help: "websocket subprotocol the server chose",
+	}, []string{"subprotocol"})
+	registry.MustRegister(upgradeDuration, statusCode, subprotocolInfo)
+
+	conn, err := dial(address, tgt.Scheme == "wss", tlsConfig, module)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(module.Timeout))
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	encodedKey := base64.StdEncoding.EncodeToString(key)
+
+	u := *tgt
+	if u.Scheme == "wss" {
+		u.Scheme = "https"
+	} else {
+		u.Scheme = "http"
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", encodedKey)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Protocol", strings.Join(module.WebSocket.Subprotocols, ", "))
+	if module.WebSocket.Origin != "" {
+		req.Header.Set("Origin", module.WebSocket.Origin)
+	}
+
+	start := time.Now()
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	upgradeDuration.Set(time.Since(start).Seconds())
+	statusCode.Set(float64(resp.StatusCode))
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket upgrade failed: %s", resp.Status)
+	}
+	sum := sha1.Sum([]byte(encodedKey + websocketGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		conn.Close()
+		return nil, errors.New("websocket upgrade failed: wrong Sec-WebSocket-Accept")
+	}
+
+	// servers that don't pick a subprotocol speak text.ircv3.net
+	ws := &wsConn{Conn: conn, reader: reader, opcode: opText}
+	subprotocol := resp.Header.Get("Sec-WebSocket-Protocol")
+	switch subprotocol {
+	case "", textSubprotocol:
+	case binarySubprotocol:
+		ws.opcode = opBinary
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("server chose unknown websocket subprotocol %q", subprotocol)
+	}
+	subprotocolInfo.WithLabelValues(subprotocol).Set(1)
+
+	conn.SetDeadline(time.Time{})
+	return ws, nil
+}
+
+// Read reads IRC lines from WebSocket messages, adding back the CRLF that
+// the protocol leaves out.
+func (c *wsConn) Read(b []byte) (int, error) {
+	for len(c.pending) == 0 {
+		opcode, payload, err := c.readMessage()
+		if err != nil {
+			return 0, err
+		}
+		if opcode == opText || opcode == opBinary {
+			c.pending = append(payload, '\r', '\n')
+		}
+	}
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// readMessage reads a whole data message, answering any control frames
+// that arrive first.
+func (c *wsConn) readMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch frameOpcode {
+		case opPing:
+			if err := c.writeFrame(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.writeFrame(opClose, payload)
+			return 0, nil, io.EOF
+		case opContinuation:
+		default:
+			opcode = frameOpcode
+		}
+		message = append(message, payload...)
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0f
+	masked := header[1]&0x80 != 0
+
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var l uint16
+		err = binary.Read(c.reader, binary.BigEndian, &l)
+		length = uint64(l)
+	case 127:
+		err = binary.Read(c.reader, binary.BigEndian, &length)
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	// IRC lines are short; anything this big is the server misbehaving
+	if length > 1<<20 {
+		return false, 0, nil, fmt.Errorf("websocket frame of %d bytes is too large", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// Write sends each complete line written as its own WebSocket message,
+// without its line ending.
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	c.partial = append(c.partial, b...)
+	var lines [][]byte
+	for {
+		i := bytes.IndexByte(c.partial, '\n')
+		if i < 0 {
+			break
+		}
+		lines = append(lines, bytes.TrimRight(c.partial[:i], "\r"))
+		c.partial = c.partial[i+1:]
+	}
+	c.writeMu.Unlock()
+
+	for _, line := range lines {
+		if err := c.writeFrame(c.opcode, line); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// writeFrame sends a single masked frame, as clients must.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, 0x80|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 0x80|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	mask := make([]byte, 4)
+	rand.Read(mask)
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame before closing the connection.
+func (c *wsConn) Close() error {
+	c.writeFrame(opClose, nil)
+	return c.Conn.Close()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serverFrame encodes an unmasked frame, as servers send them.
+func serverFrame(fin bool, opcode byte, payload string) []byte {
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, 126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		panic("payload too long for a test frame")
+	}
+	return append(frame, payload...)
+}
+
+func TestWSConnRead(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ws := &wsConn{Conn: client, reader: bufio.NewReader(client), opcode: opText}
+
+	long := strings.Repeat("x", 300)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- func() error {
+			for _, frame := range [][]byte{
+				serverFrame(true, opText, "PING :one"),
+				// a message split across a continuation frame
+				serverFrame(false, opBinary, ":srv 001 "),
+				serverFrame(true, opContinuation, "nick :hello"),
+				serverFrame(true, opPing, "are you there"),
+			} {
+				if _, err := server.Write(frame); err != nil {
+					return err
+				}
+			}
+			// the client has to answer the ping before reading on
+			peer := &wsConn{Conn: server, reader: bufio.NewReader(server)}
+			_, opcode, payload, err := peer.readFrame()
+			if err != nil {
+				return err
+			}
+			if opcode != opPong || string(payload) != "are you there" {
+				return fmt.Errorf("got frame %#x %q, want pong echoing the ping", opcode, payload)
+			}
+			if _, err := server.Write(serverFrame(true, opText, long)); err != nil {
+				return err
+			}
+			_, err = server.Write(serverFrame(true, opClose, ""))
+			return err
+		}()
+	}()
+
+	reader := bufio.NewReader(ws)
+	for _, want := range []string{"PING :one\r\n", ":srv 001 nick :hello\r\n", long + "\r\n"} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading %q: %v", want, err)
+		}
+		if line != want {
+			t.Errorf("read %q, want %q", line, want)
+		}
+	}
+
+	// the close frame is answered, so read it off before checking the end
+	go func() {
+		peer := &wsConn{Conn: server, reader: bufio.NewReader(server)}
+		peer.readFrame()
+	}()
+	if _, err := reader.ReadString('\n'); err != io.EOF {
+		t.Errorf("read after close frame returned %v, want EOF", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWSConnWrite(t *testing.T) {
+	for _, opcode := range []byte{opText, opBinary} {
+		client, server := net.Pipe()
+		ws := &wsConn{Conn: client, reader: bufio.NewReader(client), opcode: opcode}
+
+		go func() {
+			// lines can be split across writes, or share one
+			fmt.Fprint(ws, "NICK probe\r\nUSER probe 0 * :real name\r\nJOIN")
+			fmt.Fprint(ws, " #chan\n")
+		}()
+
+		peer := &wsConn{Conn: server, reader: bufio.NewReader(server)}
+		for _, want := range []string{"NICK probe", "USER probe 0 * :real name", "JOIN #chan"} {
+			fin, frameOpcode, payload, err := peer.readFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !fin || frameOpcode != opcode || string(payload) != want {
+				t.Errorf("got frame fin=%v %#x %q, want fin=true %#x %q", fin, frameOpcode, payload, opcode, want)
+			}
+		}
+		client.Close()
+		server.Close()
+	}
+}
+
+func TestWSConnWriteMasks(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	ws := &wsConn{Conn: client, reader: bufio.NewReader(client), opcode: opText}
+
+	go fmt.Fprint(ws, "PING :x\r\n")
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	if header[1]&0x80 == 0 {
+		t.Error("client frame is not masked")
+	}
+	io.ReadFull(server, make([]byte, 4+int(header[1]&0x7f)))
+}
+
+func TestDialWebSocket(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		subprotocol string
+		badAccept   bool
+		opcode      byte
+		wantErr     bool
+	}{
+		{name: "binary", status: 101, subprotocol: binarySubprotocol, opcode: opBinary},
+		{name: "text", status: 101, subprotocol: textSubprotocol, opcode: opText},
+		{name: "no subprotocol", status: 101, opcode: opText},
+		{name: "unknown subprotocol", status: 101, subprotocol: "chat", wantErr: true},
+		{name: "not found", status: 404, wantErr: true},
+		{name: "wrong accept key", status: 101, badAccept: true, wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+
+			requests := make(chan *http.Request, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				req, err := http.ReadRequest(bufio.NewReader(conn))
+				if err != nil {
+					return
+				}
+				requests <- req
+				sum := sha1.Sum([]byte(req.Header.Get("Sec-WebSocket-Key") + websocketGUID))
+				accept := base64.StdEncoding.EncodeToString(sum[:])
+				if test.badAccept {
+					accept = base64.StdEncoding.EncodeToString(make([]byte, sha1.Size))
+				}
+				fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\n", test.status, http.StatusText(test.status))
+				if test.status == 101 {
+					fmt.Fprintf(conn, "Upgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n", accept)
+					if test.subprotocol != "" {
+						fmt.Fprintf(conn, "Sec-WebSocket-Protocol: %s\r\n", test.subprotocol)
+					}
+				} else {
+					fmt.Fprint(conn, "Content-Length: 0\r\n")
+				}
+				fmt.Fprint(conn, "\r\n")
+				// hold the connection open until the client is done
+				conn.Read(make([]byte, 1))
+			}()
+
+			tgt := &url.URL{Scheme: "ws", Host: l.Addr().String(), Path: "/irc"}
+			ws, err := dialWebSocket(tgt, tgt.Host, nil, defaultModule, prometheus.NewRegistry())
+			if test.wantErr {
+				if err == nil {
+					ws.Close()
+					t.Fatal("dialWebSocket() succeeded, want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ws.Close()
+			if ws.opcode != test.opcode {
+				t.Errorf("opcode = %#x, want %#x", ws.opcode, test.opcode)
+			}
+
+			req := <-requests
+			if req.URL.Path != "/irc" {
+				t.Errorf("requested %q, want /irc", req.URL.Path)
+			}
+			for header, want := range map[string]string{
+				"Upgrade":                "websocket",
+				"Sec-WebSocket-Version":  "13",
+				"Sec-WebSocket-Protocol": textSubprotocol + ", " + binarySubprotocol,
+			} {
+				if got := req.Header.Get(header); got != want {
+					t.Errorf("%s header = %q, want %q", header, got, want)
+				}
+			}
+		})
+	}
+}